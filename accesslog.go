@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// accessLog logs the requests handled by the load balancer.
+type accessLog struct {
+	sampleRate float64
+}
+
+// newAccessLog returns the access log of config, or nil if it is
+// disabled.
+func newAccessLog(config Config) (*accessLog, error) {
+	sampleRate := 1.0
+	if config.AccessLogSampleRate != nil {
+		sampleRate = *config.AccessLogSampleRate
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("parsing accessLogSampleRate: must be between 0 and 1")
+	}
+	if !config.AccessLog {
+		return nil, nil
+	}
+	return &accessLog{sampleRate: sampleRate}, nil
+}
+
+// Log logs r, handled by route and answered with status in d, unless it
+// is not sampled. id is the request ID, empty if there is none.
+func (l *accessLog) Log(r *http.Request, client, route, id string, status int, d time.Duration) {
+	// The response is implicitly successful when nothing was written.
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := status >= 200 && status < 400
+	if success && l.sampleRate < 1 && rand.Float64() >= l.sampleRate {
+		return
+	}
+
+	args := []any{
+		"method", r.Method,
+		"path", r.URL.RequestURI(),
+		"host", r.Host,
+		"client", client,
+		"route", route,
+		"status", status,
+		"duration", d.String(),
+	}
+	if id != "" {
+		args = append(args, "requestID", id)
+	}
+	slog.Info("Request", args...)
+}
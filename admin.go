@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// redacted replaces secret configuration values.
+const redacted = "REDACTED"
+
+// AdminConfig represents the admin API configuration.
+type AdminConfig struct {
+	// ListenPort of the admin API.
+	ListenPort string `json:"listenPort"`
+	// Username for HTTP basic authentication.
+	Username string `json:"username"`
+	// Password for HTTP basic authentication.
+	//
+	// Authentication is disabled when no password is set, the admin API
+	// then only listening on the loopback interface, e.g. on
+	// 127.0.0.1:9090 for :9090, so that other hosts cannot reach it. Its
+	// probes, not authenticated, then cannot be reached by other hosts
+	// either.
+	Password string `json:"password"`
+	// Pprof serves the Go profiling endpoints under /debug/pprof/.
+	Pprof bool `json:"pprof"`
+	// DisableMetrics stops serving the metrics under /metrics, e.g. when
+	// they are pushed to StatsD instead.
+	DisableMetrics bool `json:"disableMetrics"`
+}
+
+// serverWeight represents the weight of a server in the admin API.
+type serverWeight struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// serverStatus represents the status of a server in the admin API.
+type serverStatus struct {
+	URL               string             `json:"url"`
+	Healthy           bool               `json:"healthy"`
+	Degraded          bool               `json:"degraded"`
+	Labels            map[string]string  `json:"labels,omitempty"`
+	Weight            int                `json:"weight"`
+	EffectiveWeight   float64            `json:"effectiveWeight"`
+	ActiveConnections int                `json:"activeConnections"`
+	Requests          int64              `json:"requests"`
+	RequestBytes      int64              `json:"requestBytes"`
+	ResponseBytes     int64              `json:"responseBytes"`
+	Load              *float64           `json:"load,omitempty"`
+	Drain             *serverDrainStatus `json:"drain,omitempty"`
+	LastCheck         *checkStatus       `json:"lastCheck,omitempty"`
+	LastChecked       *time.Time         `json:"lastChecked,omitempty"`
+	NextCheck         *time.Time         `json:"nextCheck,omitempty"`
+}
+
+// serverDrainStatus represents the gradual drain of a server in the admin
+// API.
+type serverDrainStatus struct {
+	URL      string     `json:"url"`
+	Draining bool       `json:"draining"`
+	Start    *time.Time `json:"start,omitempty"`
+	Duration Duration   `json:"duration,omitempty"`
+	// Progress is the share of the traffic of the server already
+	// drained, from 0 to 1.
+	Progress float64 `json:"progress"`
+}
+
+// newServerDrainStatus returns the drain status of s, whose mutex must be
+// held.
+func newServerDrainStatus(s *Server) serverDrainStatus {
+	status := serverDrainStatus{URL: s.RedactedURL()}
+	if s.Drain != nil {
+		status.Draining = true
+		start := s.Drain.start
+		status.Start = &start
+		status.Duration = Duration(s.Drain.duration)
+		status.Progress = 1 - s.Drain.share(time.Now())
+	}
+	return status
+}
+
+// checkStatus represents the result of the last health check of a server
+// in the admin API.
+type checkStatus struct {
+	Time       time.Time `json:"time"`
+	LatencyMs  float64   `json:"latencyMs"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// connectionStatus represents the connections of a server in the admin API.
+type connectionStatus struct {
+	URL               string `json:"url"`
+	ActiveConnections int    `json:"activeConnections"`
+}
+
+// connectionsStatus represents the requests being handled in the admin API.
+type connectionsStatus struct {
+	// InFlight is the number of requests being handled, including queued ones.
+	InFlight int64 `json:"inFlight"`
+	// Queued is the number of requests waiting in the queue.
+	Queued int64 `json:"queued"`
+	// ActiveConnections is the total of the active connections of the servers.
+	ActiveConnections int                `json:"activeConnections"`
+	Servers           []connectionStatus `json:"servers"`
+}
+
+// drainStatus represents whether the load balancer is drained in the
+// admin API.
+type drainStatus struct {
+	Drained bool `json:"drained"`
+	// InFlight is the number of requests remaining.
+	InFlight int64 `json:"inFlight"`
+}
+
+// serverShare represents the requests proxied to a server of a pool in
+// the admin API.
+type serverShare struct {
+	URL      string `json:"url"`
+	Weight   int    `json:"weight"`
+	Requests int64  `json:"requests"`
+	// Share is the fraction of the requests of the pool.
+	Share float64 `json:"share"`
+}
+
+// poolBalance represents the distribution of the requests across the
+// servers of a pool in the admin API.
+type poolBalance struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+	// Imbalance is the coefficient of variation of the requests per unit
+	// of weight of the servers, 0 when they are distributed as weighted.
+	Imbalance float64       `json:"imbalance"`
+	Servers   []serverShare `json:"servers"`
+}
+
+// newPoolBalance returns the distribution of the requests of pool.
+//
+// Servers shared by several pools count the requests of all of them.
+func newPoolBalance(pool *Pool) poolBalance {
+	b := poolBalance{Name: pool.Name, Servers: []serverShare{}}
+	var perWeight []float64
+	for _, server := range pool.Servers {
+		server.Mu.Lock()
+		weight := server.Weight
+		server.Mu.Unlock()
+
+		requests := server.Requests.Load()
+		b.Requests += requests
+		b.Servers = append(b.Servers, serverShare{URL: server.RedactedURL(), Weight: weight, Requests: requests})
+		if weight > 0 {
+			perWeight = append(perWeight, float64(requests)/float64(weight))
+		}
+	}
+	for i := range b.Servers {
+		if b.Requests > 0 {
+			b.Servers[i].Share = float64(b.Servers[i].Requests) / float64(b.Requests)
+		}
+	}
+	b.Imbalance = coefficientOfVariation(perWeight)
+	return b
+}
+
+// coefficientOfVariation returns the standard deviation of values divided
+// by their mean, or 0 if their mean is 0.
+func coefficientOfVariation(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	if sum == 0 {
+		return 0
+	}
+	mean := sum / float64(len(values))
+	var variance float64
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(len(values))
+	return math.Sqrt(variance) / mean
+}
+
+// routeStatus represents a route in the admin API.
+type routeStatus struct {
+	Name       string `json:"name"`
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	PathRegex  string `json:"pathRegex,omitempty"`
+	Pool       string `json:"pool"`
+}
+
+// poolStatus represents a pool in the admin API.
+type poolStatus struct {
+	Name         string   `json:"name"`
+	Algorithm    string   `json:"algorithm"`
+	PreserveHost bool     `json:"preserveHost"`
+	StripPrefix  string   `json:"stripPrefix,omitempty"`
+	AddPrefix    string   `json:"addPrefix,omitempty"`
+	Servers      []string `json:"servers"`
+}
+
+// routingStatus represents the routing table in the admin API.
+type routingStatus struct {
+	// Routes in the order they are matched.
+	Routes []routeStatus `json:"routes"`
+	Pools  []poolStatus  `json:"pools"`
+}
+
+// newRoutingStatus returns the routing table of st.
+func newRoutingStatus(st *State) routingStatus {
+	status := routingStatus{Routes: []routeStatus{}, Pools: []poolStatus{}}
+	for _, route := range st.Router.Routes() {
+		rs := routeStatus{Name: route.Name, PathPrefix: route.Prefix, Pool: route.Pool.Name}
+		if route.Regex != nil {
+			rs.PathRegex = route.Regex.String()
+		}
+		status.Routes = append(status.Routes, rs)
+	}
+	for _, name := range slices.Sorted(maps.Keys(st.Pools)) {
+		pool := st.Pools[name]
+		ps := poolStatus{Name: name, Algorithm: pool.Algorithm, PreserveHost: pool.PreserveHost, StripPrefix: pool.StripPrefix, AddPrefix: pool.AddPrefix, Servers: []string{}}
+		for _, server := range pool.Servers {
+			ps.Servers = append(ps.Servers, server.RedactedURL())
+		}
+		status.Pools = append(status.Pools, ps)
+	}
+	return status
+}
+
+// newServerStatus returns the status of s.
+func newServerStatus(s *Server) serverStatus {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	var load *float64
+	if s.LastCheck.LoadKnown {
+		v := s.LastCheck.Load
+		load = &v
+	}
+
+	var lastCheck *checkStatus
+	var lastChecked, nextCheck *time.Time
+	if !s.LastCheck.Time.IsZero() {
+		t := s.LastCheck.Time
+		lastChecked = &t
+		lastCheck = &checkStatus{
+			Time:       s.LastCheck.Time,
+			LatencyMs:  float64(s.LastCheck.Latency.Microseconds()) / 1000,
+			StatusCode: s.LastCheck.StatusCode,
+			Error:      s.LastCheck.Error,
+		}
+	}
+
+	if !s.NextCheck.IsZero() {
+		t := s.NextCheck
+		nextCheck = &t
+	}
+
+	var drain *serverDrainStatus
+	if s.Drain != nil {
+		d := newServerDrainStatus(s)
+		drain = &d
+	}
+
+	return serverStatus{
+		URL:               s.RedactedURL(),
+		Healthy:           s.Healthy,
+		Degraded:          s.LastCheck.Degraded,
+		Labels:            s.Labels,
+		Weight:            s.Weight,
+		EffectiveWeight:   float64(s.Weight) * s.WeightFactor * s.Drain.share(time.Now()),
+		ActiveConnections: s.ActiveConnections,
+		Requests:          s.Requests.Load(),
+		RequestBytes:      s.RequestBytes.Load(),
+		ResponseBytes:     s.ResponseBytes.Load(),
+		Load:              load,
+		Drain:             drain,
+		LastCheck:         lastCheck,
+		LastChecked:       lastChecked,
+		NextCheck:         nextCheck,
+	}
+}
+
+// newAdminHandler returns the handler serving the admin API.
+//
+// Server URLs in paths must be escaped, e.g.
+// /admin/servers/http:%2F%2Flocalhost:8083/weight.
+//
+// The liveness and readiness probes, /healthz and /readyz, do not
+// require authentication.
+func newAdminHandler(config *AdminConfig, lb *LoadBalancer) http.Handler {
+	mux := http.NewServeMux()
+
+	// Effective configuration with secrets redacted.
+	mux.HandleFunc("GET /admin/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, lb.State().Config.Redacted())
+	})
+
+	// Status of all servers.
+	mux.HandleFunc("GET /admin/servers", func(w http.ResponseWriter, r *http.Request) {
+		statuses := []serverStatus{}
+		for _, server := range lb.State().Servers {
+			statuses = append(statuses, newServerStatus(server))
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	})
+
+	// Requests being handled and active connections of the servers, e.g.
+	// to diagnose leaks.
+	mux.HandleFunc("GET /admin/connections", func(w http.ResponseWriter, r *http.Request) {
+		st := lb.State()
+		status := connectionsStatus{InFlight: lb.InFlight(), Servers: []connectionStatus{}}
+		if st.Queue != nil {
+			status.Queued = st.Queue.Depth()
+		}
+		for _, server := range st.Servers {
+			server.Mu.Lock()
+			n := server.ActiveConnections
+			server.Mu.Unlock()
+
+			status.ActiveConnections += n
+			status.Servers = append(status.Servers, connectionStatus{URL: server.RedactedURL(), ActiveConnections: n})
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	// Answer all new requests with 503, letting the requests in flight
+	// complete, or resume proxying them.
+	mux.HandleFunc("POST /admin/drain-all", func(w http.ResponseWriter, r *http.Request) {
+		lb.SetRejected(true)
+		slog.Info("Load balancer drained")
+		writeJSON(w, http.StatusOK, drainStatus{Drained: true, InFlight: lb.InFlight()})
+	})
+	mux.HandleFunc("POST /admin/undrain-all", func(w http.ResponseWriter, r *http.Request) {
+		lb.SetRejected(false)
+		slog.Info("Load balancer undrained")
+		writeJSON(w, http.StatusOK, drainStatus{Drained: false, InFlight: lb.InFlight()})
+	})
+
+	// Distribution of the requests across the servers of each pool.
+	mux.HandleFunc("GET /admin/balance", func(w http.ResponseWriter, r *http.Request) {
+		st := lb.State()
+		pools := []poolBalance{}
+		for _, name := range slices.Sorted(maps.Keys(st.Pools)) {
+			pools = append(pools, newPoolBalance(st.Pools[name]))
+		}
+		writeJSON(w, http.StatusOK, pools)
+	})
+
+	// Routes and pools, as matched by the router.
+	mux.HandleFunc("GET /admin/routes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, newRoutingStatus(lb.State()))
+	})
+
+	// Metrics in the Prometheus text format.
+	if !config.DisableMetrics {
+		mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			writeMetrics(w, lb)
+		})
+	}
+
+	// Check the health of one or all servers immediately.
+	mux.HandleFunc("POST /admin/servers/check", func(w http.ResponseWriter, r *http.Request) {
+		checkServers(w, r, lb.State(), lb.State().Servers)
+	})
+	mux.HandleFunc("POST /admin/servers/{url}/check", func(w http.ResponseWriter, r *http.Request) {
+		st := lb.State()
+		server := findServer(st.Servers, r.PathValue("url"))
+		if server == nil {
+			http.Error(w, "Server not found", http.StatusNotFound)
+			return
+		}
+		checkServers(w, r, st, []*Server{server})
+	})
+
+	// Update the weight of a server, taking effect immediately.
+	mux.HandleFunc("POST /admin/servers/{url}/weight", func(w http.ResponseWriter, r *http.Request) {
+		st := lb.State()
+		server := findServer(st.Servers, r.PathValue("url"))
+		if server == nil {
+			http.Error(w, "Server not found", http.StatusNotFound)
+			return
+		}
+
+		var body struct {
+			Weight *int `json:"weight"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Weight == nil {
+			http.Error(w, "Invalid body, expected {\"weight\": <int>}", http.StatusBadRequest)
+			return
+		}
+		if *body.Weight < 0 {
+			http.Error(w, "Weight must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		server.Mu.Lock()
+		server.Weight = *body.Weight
+		server.Mu.Unlock()
+		for _, pool := range st.Pools {
+			if slices.Contains(pool.Servers, server) {
+				pool.serversChanged()
+			}
+		}
+
+		slog.Info("Server weight set", "server", server.RedactedURL(), "weight", *body.Weight)
+		writeJSON(w, http.StatusOK, serverWeight{URL: server.RedactedURL(), Weight: *body.Weight})
+	})
+
+	// Gradually drain a server, its traffic linearly decreasing to zero
+	// over the duration, report the progress of its drain, or cancel it.
+	mux.HandleFunc("POST /admin/servers/{url}/drain", func(w http.ResponseWriter, r *http.Request) {
+		server := findServer(lb.State().Servers, r.PathValue("url"))
+		if server == nil {
+			http.Error(w, "Server not found", http.StatusNotFound)
+			return
+		}
+		d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid duration, expected e.g. ?duration=5m", http.StatusBadRequest)
+			return
+		}
+
+		server.Mu.Lock()
+		server.Drain = &serverDrain{start: time.Now(), duration: d}
+		status := newServerDrainStatus(server)
+		server.Mu.Unlock()
+
+		slog.Info("Draining server", "server", server.RedactedURL(), "duration", d.String())
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("GET /admin/servers/{url}/drain", func(w http.ResponseWriter, r *http.Request) {
+		server := findServer(lb.State().Servers, r.PathValue("url"))
+		if server == nil {
+			http.Error(w, "Server not found", http.StatusNotFound)
+			return
+		}
+		server.Mu.Lock()
+		status := newServerDrainStatus(server)
+		server.Mu.Unlock()
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("DELETE /admin/servers/{url}/drain", func(w http.ResponseWriter, r *http.Request) {
+		server := findServer(lb.State().Servers, r.PathValue("url"))
+		if server == nil {
+			http.Error(w, "Server not found", http.StatusNotFound)
+			return
+		}
+		server.Mu.Lock()
+		server.Drain = nil
+		status := newServerDrainStatus(server)
+		server.Mu.Unlock()
+
+		slog.Info("Server drain canceled", "server", server.RedactedURL())
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	if config.Pprof {
+		mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+		mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	}
+
+	probes := http.NewServeMux()
+	probes.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	// Readiness fails while draining on shutdown or with drain-all.
+	probes.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if lb.Draining() || lb.Rejected() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		st := lb.State()
+		if st.Config.StartUnhealthy && countHealthy(st.Servers) == 0 {
+			http.Error(w, "no healthy server", http.StatusServiceUnavailable)
+			return
+		}
+		if st.Config.MinHealthyServersUnready && st.belowMinHealthy.Load() {
+			http.Error(w, "not enough healthy servers", http.StatusServiceUnavailable)
+			return
+		}
+		if st.readinessCheck != nil {
+			if ok, healthy := st.readinessCheck.Run(r.Context(), st.healthChecker, st.Servers); !ok {
+				http.Error(w, fmt.Sprintf("not enough healthy servers: %d of %d", healthy, len(st.Servers)), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ok\n"))
+	})
+	// Unknown endpoints.
+	mux.HandleFunc("/", lb.NotFound)
+	probes.Handle("/", basicAuth(config, mux))
+
+	return probes
+}
+
+// adminAddress returns the address the admin API described by config
+// listens on: its listenPort, on the loopback interface if it has no
+// password.
+func adminAddress(config *AdminConfig) string {
+	if config.Password != "" {
+		return config.ListenPort
+	}
+	host, port, err := net.SplitHostPort(config.ListenPort)
+	if err != nil || host == "localhost" {
+		return config.ListenPort
+	}
+	ip, err := netip.ParseAddr(host)
+	switch {
+	case err == nil && ip.IsLoopback():
+		return config.ListenPort
+	case err == nil && ip.Is6() && !ip.Is4In6():
+		return net.JoinHostPort("::1", port)
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// basicAuth requires requests to next to use the credentials in config.
+func basicAuth(config *AdminConfig, next http.Handler) http.Handler {
+	if config.Password == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(config.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(config.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkServers checks the health of servers concurrently and writes their
+// resulting status.
+func checkServers(w http.ResponseWriter, r *http.Request, st *State, servers []*Server) {
+	if st.healthChecker == nil {
+		http.Error(w, "Health checks are disabled", http.StatusConflict)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), st.healthChecker.checkTimeout(server))
+			defer cancel()
+			st.healthChecker.Update(ctx, server)
+		}()
+	}
+	wg.Wait()
+
+	statuses := []serverStatus{}
+	for _, server := range servers {
+		statuses = append(statuses, newServerStatus(server))
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// findServer returns the server with the given URL, as configured or
+// redacted, or nil if there is none.
+func findServer(servers []*Server, rawURL string) *Server {
+	for _, server := range servers {
+		if server.URL.String() == rawURL || server.RedactedURL() == rawURL {
+			return server
+		}
+	}
+	return nil
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
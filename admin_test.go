@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadinessQuorum(t *testing.T) {
+	var failing1, failing2 atomic.Bool
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}, {"url": %q}],
+		"healthCheckInterval": "1h",
+		"readinessCheck": {"quorum": 0.5}
+	}`, failingBackend(t, &failing1), failingBackend(t, &failing2)))
+	admin := newAdminHandler(&AdminConfig{}, lb)
+
+	// The probe checks the servers, without waiting for the scheduled checks.
+	for _, tt := range []struct {
+		failing1, failing2 bool
+		want               int
+	}{
+		{false, false, http.StatusOK},
+		{false, true, http.StatusOK},
+		{true, true, http.StatusServiceUnavailable},
+		{true, false, http.StatusOK},
+	} {
+		failing1.Store(tt.failing1)
+		failing2.Store(tt.failing2)
+		if code := serve(admin, httptest.NewRequest("GET", "/readyz", nil)).Code; code != tt.want {
+			t.Errorf("readiness with failing servers %v, %v: %d, want %d", tt.failing1, tt.failing2, code, tt.want)
+		}
+	}
+}
+
+func TestReadinessHungCheck(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"healthCheckInterval": "1s",
+		"readinessCheck": {"timeout": "100ms"}
+	}`, backend.URL))
+	admin := newAdminHandler(&AdminConfig{}, lb)
+
+	// A forced check holds the server while the probe runs, until the
+	// check deadline.
+	checked := make(chan struct{})
+	go func() {
+		serve(admin, httptest.NewRequest("POST", "/admin/servers/check", nil))
+		close(checked)
+	}()
+	for len(lb.State().Servers[0].checkMu) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The probe gives up waiting and uses the health last recorded.
+	start := time.Now()
+	if code := serve(admin, httptest.NewRequest("GET", "/readyz", nil)).Code; code != http.StatusOK {
+		t.Errorf("readiness while a check runs: %d, want 200", code)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("readiness took %s, want its timeout", d)
+	}
+
+	select {
+	case <-checked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forced check of a server that never answers did not end")
+	}
+	if healthy(lb.State().Servers[0]) {
+		t.Error("server that never answers is healthy")
+	}
+}
+
+func TestForceCheck(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	backendURL := failingBackend(t, &failing)
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"healthCheckInterval": "1h",
+		"startUnhealthy": true
+	}`, backendURL))
+	admin := newAdminHandler(&AdminConfig{}, lb)
+	server := lb.State().Servers[0]
+	path := "/admin/servers/" + url.PathEscape(server.URL.String()) + "/check"
+
+	if code := serve(admin, httptest.NewRequest("POST", path, nil)).Code; code != http.StatusOK {
+		t.Fatalf("forced check: %d, want 200", code)
+	}
+	if healthy(server) {
+		t.Error("server failing its check is healthy")
+	}
+
+	// The backend comes up.
+	failing.Store(false)
+	w := serve(admin, httptest.NewRequest("POST", path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("forced check: %d, want 200", w.Code)
+	}
+	if !healthy(server) {
+		t.Error("server passing its check is unhealthy")
+	}
+	if code := serve(lb, httptest.NewRequest("GET", "/", nil)).Code; code != http.StatusOK {
+		t.Errorf("request after the forced check: %d, want 200", code)
+	}
+
+	if code := serve(admin, httptest.NewRequest("POST", "/admin/servers/http:%2F%2Fother:80/check", nil)).Code; code != http.StatusNotFound {
+		t.Errorf("forced check of an unknown server: %d, want 404", code)
+	}
+}
+
+func TestAdminRedactsSecrets(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": "http://user:secret1@%s", "healthCheckURL": "http://user:secret2@%[1]s/health"}],
+		"pools": {"api": {"servers": ["token-secret3@%[1]s"]}},
+		"routes": [{"pathPrefix": "/api", "pool": "api"}],
+		"healthCheckInterval": "1h",
+		"admin": {"listenPort": ":0", "password": "secret4"}
+	}`, backendURL.Host))
+	st := lb.State()
+	st.healthChecker.UpdateAll(t.Context(), st.Servers)
+	admin := newAdminHandler(&AdminConfig{}, lb)
+
+	for _, path := range []string{"/admin/config", "/admin/servers", "/admin/routes", "/admin/balance", "/admin/connections", "/metrics"} {
+		body := serve(admin, httptest.NewRequest("GET", path, nil)).Body.String()
+		if strings.Contains(body, "secret") {
+			t.Errorf("%s shows a secret:\n%s", path, body)
+		}
+		if !strings.Contains(body, redacted) {
+			t.Errorf("%s has nothing %s:\n%s", path, redacted, body)
+		}
+	}
+
+	if !strings.Contains(st.Config.Servers[0].URL, "secret1") {
+		t.Error("redacting the configuration modified it")
+	}
+
+	// Servers can be found by their redacted URL.
+	path := "/admin/servers/" + url.PathEscape(st.Servers[0].RedactedURL()) + "/check"
+	if code := serve(admin, httptest.NewRequest("POST", path, nil)).Code; code != http.StatusOK {
+		t.Errorf("forced check of a server by its redacted URL: %d, want 200", code)
+	}
+}
+
+func TestSetWeight(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}, {"url": %q}],
+		"algorithm": "weighted-random",
+		"disableHealthChecks": true
+	}`, newBackend(t, handler).URL, newBackend(t, handler).URL))
+	admin := newAdminHandler(&AdminConfig{}, lb)
+	servers := lb.State().Servers
+	path := "/admin/servers/" + url.PathEscape(servers[0].URL.String()) + "/weight"
+
+	// share returns the share of n requests the first server got.
+	share := func(n int) float64 {
+		before := servers[0].Requests.Load()
+		for range n {
+			serve(lb, httptest.NewRequest("GET", "/", nil))
+		}
+		return float64(servers[0].Requests.Load()-before) / float64(n)
+	}
+	if got := share(2000); got < 0.45 || got > 0.55 {
+		t.Errorf("first server got %.3f of the requests with equal weights, want 0.5", got)
+	}
+
+	w := serve(admin, httptest.NewRequest("POST", path, strings.NewReader(`{"weight": 3}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("setting the weight: %d, want 200", w.Code)
+	}
+	if got := share(2000); got < 0.7 || got > 0.8 {
+		t.Errorf("first server got %.3f of the requests with weight 3, want 0.75", got)
+	}
+
+	for _, tt := range []struct {
+		path, body string
+		want       int
+	}{
+		{path, `{"weight": -1}`, http.StatusBadRequest},
+		{path, `{}`, http.StatusBadRequest},
+		{path, `weight`, http.StatusBadRequest},
+		{"/admin/servers/http:%2F%2Fother:80/weight", `{"weight": 1}`, http.StatusNotFound},
+	} {
+		if code := serve(admin, httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))).Code; code != tt.want {
+			t.Errorf("setting the weight with %s: %d, want %d", tt.body, code, tt.want)
+		}
+	}
+	if servers[0].Weight != 3 {
+		t.Errorf("weight is %d after invalid updates, want 3", servers[0].Weight)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	lb := newTestLoadBalancer(t, `{"servers": ["backend:80"], "disableHealthChecks": true}`)
+	for _, tt := range []struct {
+		name   string
+		config *AdminConfig
+		auth   bool
+		want   int
+	}{
+		{"enabled", &AdminConfig{Pprof: true}, false, http.StatusOK},
+		{"disabled", &AdminConfig{}, false, http.StatusNotFound},
+		{"without credentials", &AdminConfig{Pprof: true, Username: "admin", Password: "secret"}, false, http.StatusUnauthorized},
+		{"with credentials", &AdminConfig{Pprof: true, Username: "admin", Password: "secret"}, true, http.StatusOK},
+	} {
+		admin := newAdminHandler(tt.config, lb)
+		for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline"} {
+			r := httptest.NewRequest("GET", path, nil)
+			if tt.auth {
+				r.SetBasicAuth("admin", "secret")
+			}
+			if code := serve(admin, r).Code; code != tt.want {
+				t.Errorf("%s: %s: %d, want %d", tt.name, path, code, tt.want)
+			}
+		}
+	}
+}
+
+func TestLastCheck(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}, {"url": "http://%s"}],
+		"healthCheckInterval": "1h"
+	}`, failingBackend(t, &failing), freeAddress(t)))
+	admin := newAdminHandler(&AdminConfig{}, lb)
+	st := lb.State()
+
+	// servers returns the status of the servers in the admin API.
+	servers := func() []serverStatus {
+		t.Helper()
+		var statuses []serverStatus
+		w := serve(admin, httptest.NewRequest("GET", "/admin/servers", nil))
+		if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+		return statuses
+	}
+	if s := servers(); s[0].LastCheck != nil || s[0].LastChecked != nil {
+		t.Errorf("server never checked has last check %+v", s[0].LastCheck)
+	}
+
+	start := time.Now()
+	st.healthChecker.UpdateAll(t.Context(), st.Servers)
+	s := servers()
+	for i, want := range []struct {
+		statusCode int
+		error      string
+	}{
+		{http.StatusInternalServerError, "status code"},
+		{0, "refused"},
+	} {
+		check := s[i].LastCheck
+		if check == nil {
+			t.Fatalf("server %d checked has no last check", i)
+		}
+		if check.StatusCode != want.statusCode || !strings.Contains(check.Error, want.error) {
+			t.Errorf("server %d last check %+v, want status code %d and error containing %q", i, check, want.statusCode, want.error)
+		}
+		if check.Time.Before(start.Add(-time.Second)) || check.LatencyMs <= 0 {
+			t.Errorf("server %d last check at %s took %gms, want now and a latency", i, check.Time, check.LatencyMs)
+		}
+	}
+
+	failing.Store(false)
+	st.healthChecker.Update(t.Context(), st.Servers[0])
+	if check := servers()[0].LastCheck; check.StatusCode != http.StatusOK || check.Error != "" {
+		t.Errorf("server passing its check has last check %+v, want status code 200 without error", check)
+	}
+}
+
+func TestRoutingStatus(t *testing.T) {
+	st := newTestState(t, `{
+		"servers": ["backend-1:8080"],
+		"preserveHost": true,
+		"pools": {
+			"api": {"servers": ["api-1:8080", "backend-1:8080"], "algorithm": "p2c", "stripPrefix": "/api", "preserveHost": false},
+			"images": {"servers": ["images:8080"], "addPrefix": "/static"}
+		},
+		"routes": [
+			{"pathRegex": "\\.png$", "pool": "images"},
+			{"pathPrefix": "/api", "pool": "api"},
+			{"name": "v2", "pathPrefix": "/api/v2", "pool": "api"}
+		],
+		"disableHealthChecks": true
+	}`)
+
+	got, err := json.Marshal(newRoutingStatus(st))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"routes":[` +
+		`{"name":"v2","pathPrefix":"/api/v2","pool":"api"},` +
+		`{"name":"/api","pathPrefix":"/api","pool":"api"},` +
+		`{"name":"\\.png$","pathRegex":"\\.png$","pool":"images"},` +
+		`{"name":"default","pool":"default"}],` +
+		`"pools":[` +
+		`{"name":"api","algorithm":"p2c","preserveHost":false,"stripPrefix":"/api","servers":["http://api-1:8080","http://backend-1:8080"]},` +
+		`{"name":"default","algorithm":"least-connections","preserveHost":true,"servers":["http://backend-1:8080"]},` +
+		`{"name":"images","algorithm":"least-connections","preserveHost":true,"addPrefix":"/static","servers":["http://images:8080"]}]}`
+	if string(got) != want {
+		t.Errorf("routing status\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestConnectionsReturnToZero(t *testing.T) {
+	release := make(chan struct{})
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		case "/close":
+			conn, _, _ := http.NewResponseController(w).Hijack()
+			conn.Close()
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"queue": {"maxInFlight": 3, "size": 10}
+	}`, backend.URL))
+	admin := newAdminHandler(&AdminConfig{}, lb)
+
+	// connections returns the connections in the admin API.
+	connections := func() connectionsStatus {
+		t.Helper()
+		var status connectionsStatus
+		w := serve(admin, httptest.NewRequest("GET", "/admin/connections", nil))
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+		return status
+	}
+
+	var wg sync.WaitGroup
+	// send sends a request to path with ctx.
+	send := func(ctx context.Context, path string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(lb, httptest.NewRequest("GET", path, nil).WithContext(ctx))
+		}()
+	}
+	// waitFor waits until the connections are want.
+	waitFor := func(want connectionsStatus) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for s := connections(); s.ActiveConnections != want.ActiveConnections || s.InFlight != want.InFlight || s.Queued != want.Queued; s = connections() {
+			if time.Now().After(deadline) {
+				t.Fatalf("connections %+v, want %+v", s, want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for range 3 {
+		send(context.Background(), "/slow")
+	}
+	waitFor(connectionsStatus{ActiveConnections: 3, InFlight: 3})
+	// The client of a queued request gives up.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	send(ctx, "/slow")
+	for _, path := range []string{"/close", "/error", "/"} {
+		send(context.Background(), path)
+	}
+	waitFor(connectionsStatus{ActiveConnections: 3, InFlight: 7, Queued: 4})
+	cancel()
+	waitFor(connectionsStatus{ActiveConnections: 3, InFlight: 6, Queued: 3})
+
+	close(release)
+	wg.Wait()
+
+	s := connections()
+	if s.InFlight != 0 || s.Queued != 0 || s.ActiveConnections != 0 || s.Servers[0].ActiveConnections != 0 {
+		t.Errorf("connections after the requests: %+v, want none", s)
+	}
+}
+
+func TestPoolBalance(t *testing.T) {
+	st := newTestState(t, `{
+		"servers": [{"url": "a:80", "weight": 1}, {"url": "b:80", "weight": 3}, {"url": "c:80", "weight": 0}],
+		"disableHealthChecks": true
+	}`)
+	pool := st.Pools[defaultPoolName]
+	a, b, c := st.Servers[0], st.Servers[1], st.Servers[2]
+
+	if got := newPoolBalance(pool); got.Requests != 0 || got.Imbalance != 0 || got.Servers[0].Share != 0 {
+		t.Errorf("balance without requests = %+v, want no requests, shares or imbalance", got)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		requests  [3]int64
+		shares    [3]float64
+		imbalance float64
+	}{
+		{"as weighted", [3]int64{10, 30, 0}, [3]float64{0.25, 0.75, 0}, 0},
+		// 20 and 6.67 requests per unit of weight.
+		{"evenly", [3]int64{20, 20, 0}, [3]float64{0.5, 0.5, 0}, 0.5},
+		// Servers without weight only count in the shares.
+		{"weightless server", [3]int64{10, 30, 40}, [3]float64{0.125, 0.375, 0.5}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, server := range []*Server{a, b, c} {
+				server.Requests.Store(tt.requests[i])
+			}
+			got := newPoolBalance(pool)
+			if got.Name != defaultPoolName || got.Requests != tt.requests[0]+tt.requests[1]+tt.requests[2] {
+				t.Errorf("balance of %s with %d requests, want %s with %d", got.Name, got.Requests, defaultPoolName, tt.requests[0]+tt.requests[1]+tt.requests[2])
+			}
+			for i, share := range got.Servers {
+				if math.Abs(share.Share-tt.shares[i]) > 1e-9 || share.Requests != tt.requests[i] {
+					t.Errorf("server %d: %+v, want %d requests and a share of %g", i, share, tt.requests[i], tt.shares[i])
+				}
+			}
+			if math.Abs(got.Imbalance-tt.imbalance) > 1e-9 {
+				t.Errorf("imbalance = %g, want %g", got.Imbalance, tt.imbalance)
+			}
+		})
+	}
+}
+
+func TestNextCheck(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	start := time.Now()
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"healthCheckInterval": "50ms"
+	}`, backend.URL))
+	admin := newAdminHandler(&AdminConfig{}, lb)
+
+	// server returns the status of the server in the admin API.
+	server := func() serverStatus {
+		t.Helper()
+		var statuses []serverStatus
+		w := serve(admin, httptest.NewRequest("GET", "/admin/servers", nil))
+		if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+		return statuses[0]
+	}
+	// The checks are scheduled in the background.
+	first := server()
+	for first.NextCheck == nil && time.Since(start) < time.Second {
+		time.Sleep(time.Millisecond)
+		first = server()
+	}
+	if first.NextCheck == nil || first.NextCheck.Before(start) || first.NextCheck.After(start.Add(time.Second)) {
+		t.Fatalf("next check scheduled at %v, want within the interval", first.NextCheck)
+	}
+
+	// The next check moves forward once a probe ran.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s := server()
+		if s.LastChecked != nil && s.NextCheck.After(*first.NextCheck) {
+			if !s.NextCheck.After(*s.LastChecked) {
+				t.Errorf("next check at %s not after the last check at %s", s.NextCheck, s.LastChecked)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("next check still at %s after the probes, last checked at %v", s.NextCheck, s.LastChecked)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminAddress(t *testing.T) {
+	for _, tt := range []struct {
+		listenPort, password, want string
+	}{
+		{":9090", "", "127.0.0.1:9090"},
+		{"0.0.0.0:9090", "", "127.0.0.1:9090"},
+		{"192.0.2.1:9090", "", "127.0.0.1:9090"},
+		{"admin.example:9090", "", "127.0.0.1:9090"},
+		{"[::]:9090", "", "[::1]:9090"},
+		{"127.0.0.2:9090", "", "127.0.0.2:9090"},
+		{"[::1]:9090", "", "[::1]:9090"},
+		{"localhost:9090", "", "localhost:9090"},
+		{":9090", "secret", ":9090"},
+		{"0.0.0.0:9090", "secret", "0.0.0.0:9090"},
+	} {
+		if got := adminAddress(&AdminConfig{ListenPort: tt.listenPort, Password: tt.password}); got != tt.want {
+			t.Errorf("adminAddress of %s with password %q = %s, want %s", tt.listenPort, tt.password, got, tt.want)
+		}
+	}
+}
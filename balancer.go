@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Balancer selects the server that handles a request.
+type Balancer interface {
+	// Next returns the next server, or nil if no server is available.
+	Next(servers []*Server) *Server
+	// OnServersChanged is called with the servers of the pool when the
+	// pool is created and when their weights change, so that balancers
+	// keeping state about them, e.g. a hash ring, rebuild it. Calls for
+	// a pool are not concurrent.
+	OnServersChanged(servers []*Server)
+}
+
+// stateless implements OnServersChanged for the balancers keeping no
+// state about the servers.
+type stateless struct{}
+
+// OnServersChanged does nothing.
+func (stateless) OnServersChanged([]*Server) {}
+
+// BalancerOptions contains the settings given to the factories of the
+// balancers.
+type BalancerOptions struct {
+	// FailoverHoldDown is the hold-down of the failover algorithm.
+	FailoverHoldDown time.Duration
+	// ConnectionsLatencyAlpha is the weight of the connections in the
+	// score of the least-connections-latency algorithm, from 0 to 1.
+	ConnectionsLatencyAlpha float64
+}
+
+// balancers contains the factories of the balancers by algorithm name.
+var (
+	balancersMu sync.RWMutex
+	balancers   = map[string]func(BalancerOptions) Balancer{
+		"least-connections": func(BalancerOptions) Balancer { return leastConnections{} },
+		"weighted-random":   func(BalancerOptions) Balancer { return weightedRandom{} },
+		"p2c":               func(BalancerOptions) Balancer { return powerOfTwoChoices{} },
+		"load-aware":        func(BalancerOptions) Balancer { return loadAware{} },
+		"failover": func(opts BalancerOptions) Balancer {
+			return failover{holdDown: opts.FailoverHoldDown}
+		},
+		"least-connections-latency": func(opts BalancerOptions) Balancer {
+			return leastConnectionsLatency{alpha: opts.ConnectionsLatencyAlpha}
+		},
+		"ip-hash":          func(BalancerOptions) Balancer { return newIPHash(false) },
+		"weighted-ip-hash": func(BalancerOptions) Balancer { return newIPHash(true) },
+	}
+)
+
+// RegisterBalancer registers the factory of the balancers implementing
+// the named algorithm, which the algorithm of the configuration and of
+// the pools can then select. It replaces the factory previously
+// registered under name, including the built-in ones.
+//
+// Each pool gets its own balancer, created on every configuration load.
+func RegisterBalancer(name string, factory func(BalancerOptions) Balancer) {
+	balancersMu.Lock()
+	defer balancersMu.Unlock()
+	balancers[name] = factory
+}
+
+// newBalancer returns the Balancer implementing the named algorithm,
+// "least-connections" when empty.
+func newBalancer(algorithm string, opts BalancerOptions) (Balancer, error) {
+	if algorithm == "" {
+		algorithm = "least-connections"
+	}
+
+	balancersMu.RLock()
+	factory, ok := balancers[algorithm]
+	balancersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %q", algorithm)
+	}
+	return factory(opts), nil
+}
+
+// leastConnections selects the healthy server with the least active connections.
+type leastConnections struct{ stateless }
+
+// Next returns the healthy server with the least active connections.
+func (leastConnections) Next(servers []*Server) *Server {
+	return nextServerLeastActive(servers)
+}
+
+// weightedRandom selects a healthy server with probability proportional
+// to its weight.
+//
+// Servers with a weight of zero are never selected.
+type weightedRandom struct{ stateless }
+
+// Next returns a random healthy server, favoring servers with a higher
+// weight, multiplied by their weight factor.
+func (weightedRandom) Next(servers []*Server) *Server {
+	var candidates []*Server
+	var weights []float64
+	var total float64
+
+	for _, server := range servers {
+		server.Mu.Lock()
+		if server.Healthy && server.Weight > 0 {
+			weight := float64(server.Weight) * server.WeightFactor
+			candidates = append(candidates, server)
+			weights = append(weights, weight)
+			total += weight
+		}
+		server.Mu.Unlock()
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	n := rand.Float64() * total
+	for i, weight := range weights {
+		if n < weight {
+			return candidates[i]
+		}
+		n -= weight
+	}
+
+	// Rounding errors may leave n slightly above the last weight.
+	return candidates[len(candidates)-1]
+}
+
+// loadAware selects a healthy server with probability proportional to
+// its weight divided by one plus the load reported by its health checks.
+//
+// Servers reporting no load are assumed to have the average load of the
+// others, so that without any reported load it behaves like weightedRandom.
+type loadAware struct{ stateless }
+
+// Next returns a random healthy server, favoring less loaded servers.
+func (loadAware) Next(servers []*Server) *Server {
+	var candidates []*Server
+	var weights, loads []float64
+	var known []bool
+	var loadSum float64
+	loadCount := 0
+
+	for _, server := range servers {
+		server.Mu.Lock()
+		if server.Healthy && server.Weight > 0 {
+			candidates = append(candidates, server)
+			weights = append(weights, float64(server.Weight))
+			loads = append(loads, server.LastCheck.Load)
+			known = append(known, server.LastCheck.LoadKnown)
+			if server.LastCheck.LoadKnown {
+				loadSum += server.LastCheck.Load
+				loadCount++
+			}
+		}
+		server.Mu.Unlock()
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var average float64
+	if loadCount > 0 {
+		average = loadSum / float64(loadCount)
+	}
+
+	var total float64
+	for i := range candidates {
+		if !known[i] {
+			loads[i] = average
+		}
+		weights[i] /= 1 + loads[i]
+		total += weights[i]
+	}
+
+	n := rand.Float64() * total
+	for i, weight := range weights {
+		if n < weight {
+			return candidates[i]
+		}
+		n -= weight
+	}
+
+	return candidates[len(candidates)-1]
+}
+
+// leastConnectionsLatency selects the healthy server with the lowest
+// score, a blend of its active connections and of the latency of its
+// last health check:
+//
+//	alpha*connections/maxConnections + (1-alpha)*latency/maxLatency
+//
+// An alpha of 1 behaves like leastConnections and an alpha of 0 selects
+// the fastest server. Servers not checked yet have no latency.
+type leastConnectionsLatency struct {
+	stateless
+	alpha float64
+}
+
+// Next returns the healthy server with the lowest score.
+func (b leastConnectionsLatency) Next(servers []*Server) *Server {
+	var candidates []*Server
+	var conns, latencies []float64
+	var maxConns, maxLatency float64
+
+	for _, server := range servers {
+		server.Mu.Lock()
+		if server.Healthy {
+			candidates = append(candidates, server)
+			conns = append(conns, float64(server.ActiveConnections))
+			latencies = append(latencies, server.LastCheck.Latency.Seconds())
+			maxConns = max(maxConns, conns[len(conns)-1])
+			maxLatency = max(maxLatency, latencies[len(latencies)-1])
+		}
+		server.Mu.Unlock()
+	}
+
+	var best *Server
+	var bestScore float64
+	for i, server := range candidates {
+		var score float64
+		if maxConns > 0 {
+			score += b.alpha * conns[i] / maxConns
+		}
+		if maxLatency > 0 {
+			score += (1 - b.alpha) * latencies[i] / maxLatency
+		}
+		if best == nil || score < bestScore {
+			best, bestScore = server, score
+		}
+	}
+	return best
+}
+
+// failover selects the healthy server with the lowest priority, servers
+// with the same priority being tried in configuration order.
+//
+// A server that recently became healthy is only selected once it has
+// stayed healthy for holdDown, unless no other server is available.
+type failover struct {
+	stateless
+	holdDown time.Duration
+}
+
+// Next returns the preferred healthy server.
+func (f failover) Next(servers []*Server) *Server {
+	var best, bestHeldDown *Server
+	bestPriority, bestHeldDownPriority := 0, 0
+	now := time.Now()
+
+	for _, server := range servers {
+		server.Mu.Lock()
+		available := server.Healthy && server.Weight > 0
+		priority := server.Priority
+		heldDown := now.Sub(server.HealthySince) < f.holdDown
+		server.Mu.Unlock()
+
+		switch {
+		case !available:
+		case heldDown:
+			if bestHeldDown == nil || priority < bestHeldDownPriority {
+				bestHeldDown, bestHeldDownPriority = server, priority
+			}
+		default:
+			if best == nil || priority < bestPriority {
+				best, bestPriority = server, priority
+			}
+		}
+	}
+
+	if best == nil {
+		return bestHeldDown
+	}
+	return best
+}
+
+// p2cAttempts is the number of random pairs of servers p2c draws before
+// scanning all of them.
+const p2cAttempts = 3
+
+// powerOfTwoChoices selects the healthy server with the least active
+// connections out of two random ones, which balances nearly as well as
+// leastConnections without scanning every server.
+type powerOfTwoChoices struct{ stateless }
+
+// Next returns the less loaded of two random healthy servers.
+func (powerOfTwoChoices) Next(servers []*Server) *Server {
+	n := len(servers)
+	if n < 2 {
+		return nextServerLeastActive(servers)
+	}
+
+	for range p2cAttempts {
+		i := rand.IntN(n)
+		j := rand.IntN(n - 1)
+		if j >= i {
+			j++
+		}
+
+		a, b := servers[i], servers[j]
+		aConns, aHealthy := activeConnections(a)
+		bConns, bHealthy := activeConnections(b)
+		switch {
+		case aHealthy && bHealthy:
+			if bConns < aConns {
+				return b
+			}
+			return a
+		case aHealthy:
+			return a
+		case bHealthy:
+			return b
+		}
+	}
+
+	// Most servers are unhealthy.
+	return nextServerLeastActive(servers)
+}
+
+// activeConnections returns the number of active connections of s and
+// whether it is healthy.
+func activeConnections(s *Server) (int, bool) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	return s.ActiveConnections, s.Healthy
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServers returns healthy servers with the given weights.
+func testServers(t testing.TB, weights ...int) []*Server {
+	t.Helper()
+	var servers []*Server
+	for i, weight := range weights {
+		server, err := newServer(ServerConfig{URL: fmt.Sprintf("backend-%d:8080", i), Weight: weight}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// shares returns the share of n selections of b each of servers got.
+func shares(b Balancer, servers []*Server, n int) []float64 {
+	counts := map[*Server]int{}
+	for range n {
+		counts[b.Next(servers)]++
+	}
+	result := make([]float64, len(servers))
+	for i, server := range servers {
+		result[i] = float64(counts[server]) / float64(n)
+	}
+	return result
+}
+
+// checkShares reports the shares differing from want by more than 0.02.
+func checkShares(t *testing.T, got, want []float64) {
+	t.Helper()
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 0.02 {
+			t.Errorf("server %d got %.3f of the selections, want %.3f", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWeightedRandomDistribution(t *testing.T) {
+	servers := testServers(t, 1, 2, 7, 0, 5)
+	// Unhealthy servers are never selected.
+	servers[4].Healthy = false
+	checkShares(t, shares(weightedRandom{}, servers, 100000), []float64{0.1, 0.2, 0.7, 0, 0})
+}
+
+func TestWeightedRandomNoCandidate(t *testing.T) {
+	servers := testServers(t, 0, 1)
+	servers[1].Healthy = false
+	if server := (weightedRandom{}).Next(servers); server != nil {
+		t.Errorf("Next = %s, want none", server.URL)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		active  []int
+		healthy []bool
+		want    int
+	}{
+		{"least active", []int{3, 1, 2}, []bool{true, true, true}, 1},
+		{"unhealthy first with fewest", []int{0, 5, 2}, []bool{false, true, true}, 2},
+		{"only the last healthy", []int{0, 0, 9}, []bool{false, false, true}, 2},
+		{"none healthy", []int{0, 0}, []bool{false, false}, -1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := testServers(t, make([]int, len(tt.active))...)
+			for i, server := range servers {
+				server.ActiveConnections = tt.active[i]
+				server.Healthy = tt.healthy[i]
+			}
+			got := (leastConnections{}).Next(servers)
+			if tt.want < 0 {
+				if got != nil {
+					t.Errorf("Next = %s, want none", got.URL)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("Next = none, want %s", servers[tt.want].URL)
+			}
+			if got != servers[tt.want] {
+				t.Errorf("Next = %s, want %s", got.URL, servers[tt.want].URL)
+			}
+		})
+	}
+}
+
+func TestLoadAwareDistribution(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		loads []float64
+		known []bool
+		want  []float64
+	}{
+		{"known loads", []float64{0, 1, 3}, []bool{true, true, true}, []float64{4.0 / 7, 2.0 / 7, 1.0 / 7}},
+		// The unknown load is the average of the others, 1.
+		{"unknown load", []float64{0, 2, 0}, []bool{true, true, false}, []float64{6.0 / 11, 2.0 / 11, 3.0 / 11}},
+		{"no load", []float64{0, 0, 0}, []bool{false, false, false}, []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := testServers(t, 1, 1, 1)
+			for i, server := range servers {
+				server.LastCheck.Load = tt.loads[i]
+				server.LastCheck.LoadKnown = tt.known[i]
+			}
+			checkShares(t, shares(loadAware{}, servers, 100000), tt.want)
+		})
+	}
+}
+
+func TestLoadAwareHealthCheck(t *testing.T) {
+	handler := func(load string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Load", load)
+		}
+	}
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}, {"url": %q}],
+		"algorithm": "load-aware",
+		"healthLoadHeader": "X-Load",
+		"healthCheckInterval": "1h"
+	}`, newBackend(t, handler("0")).URL, newBackend(t, handler("3")).URL))
+	st := lb.State()
+	st.healthChecker.UpdateAll(t.Context(), st.Servers)
+
+	for range 1000 {
+		serve(lb, httptest.NewRequest("GET", "/", nil))
+	}
+	// The shares are 0.8 and 0.2.
+	if got := st.Servers[0].Requests.Load(); got < 720 || got > 880 {
+		t.Errorf("least loaded server got %d of 1000 requests, want 800", got)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name         string
+		priorities   []int
+		healthySince []time.Duration
+		healthy      []bool
+		want         int
+	}{
+		{"preferred", []int{1, 0, 2}, []time.Duration{0, 0, 0}, []bool{true, true, true}, 1},
+		{"configuration order", []int{0, 0}, []time.Duration{0, 0}, []bool{true, true}, 0},
+		{"preferred unhealthy", []int{0, 1, 2}, []time.Duration{0, 0, 0}, []bool{false, true, true}, 1},
+		{"preferred held down", []int{0, 1}, []time.Duration{30 * time.Second, 0}, []bool{true, true}, 1},
+		{"preferred hold-down over", []int{0, 1}, []time.Duration{2 * time.Minute, 0}, []bool{true, true}, 0},
+		{"all held down", []int{1, 0}, []time.Duration{30 * time.Second, 10 * time.Second}, []bool{true, true}, 1},
+		{"only held down available", []int{0, 1}, []time.Duration{30 * time.Second, 0}, []bool{true, false}, 0},
+		{"none", []int{0, 1}, []time.Duration{0, 0}, []bool{false, false}, -1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := testServers(t, make([]int, len(tt.priorities))...)
+			for i, server := range servers {
+				server.Weight = 1
+				server.Priority = tt.priorities[i]
+				server.Healthy = tt.healthy[i]
+				// Servers healthy since startup.
+				if tt.healthySince[i] > 0 {
+					server.HealthySince = now.Add(-tt.healthySince[i])
+				}
+			}
+			got := (failover{holdDown: time.Minute}).Next(servers)
+			if tt.want < 0 {
+				if got != nil {
+					t.Errorf("Next = %s, want none", got.URL)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("Next = none, want %s", servers[tt.want].URL)
+			}
+			if got != servers[tt.want] {
+				t.Errorf("Next = %s, want %s", got.URL, servers[tt.want].URL)
+			}
+		})
+	}
+}
+
+func TestFailoverHoldDownRecovery(t *testing.T) {
+	var failing atomic.Bool
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q, "priority": 0}, {"url": %q, "priority": 1}],
+		"algorithm": "failover",
+		"failoverHoldDown": "100ms",
+		"healthCheckInterval": "1h"
+	}`, failingBackend(t, &failing), backend.URL))
+	st := lb.State()
+	primary, secondary := st.Servers[0], st.Servers[1]
+
+	failing.Store(true)
+	st.healthChecker.UpdateAll(t.Context(), st.Servers)
+	failing.Store(false)
+	st.healthChecker.Update(t.Context(), primary)
+
+	// The primary recovered but is held down.
+	serve(lb, httptest.NewRequest("GET", "/", nil))
+	if secondary.Requests.Load() != 1 {
+		t.Errorf("request sent to the primary just recovered, want the secondary")
+	}
+	time.Sleep(150 * time.Millisecond)
+	serve(lb, httptest.NewRequest("GET", "/", nil))
+	if primary.Requests.Load() != 1 {
+		t.Errorf("request after the hold-down not sent to the primary")
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	servers := testServers(t, 1, 1, 1, 1, 1)
+	servers[0].Healthy = false
+	servers[3].Healthy = false
+	servers[1].ActiveConnections = 10
+	counts := map[*Server]int{}
+	for range 10000 {
+		counts[(powerOfTwoChoices{}).Next(servers)]++
+	}
+	if counts[servers[0]] != 0 || counts[servers[3]] != 0 {
+		t.Errorf("unhealthy servers selected %d and %d times, want never", counts[servers[0]], counts[servers[3]])
+	}
+	// The busy server is only selected when drawn with an unhealthy one,
+	// 4 of the 20 pairs.
+	if counts[servers[1]] > 2600 {
+		t.Errorf("busiest server selected %d of 10000 times, want about 2200", counts[servers[1]])
+	}
+
+	servers[1].Healthy, servers[2].Healthy, servers[4].Healthy = false, false, false
+	if got := (powerOfTwoChoices{}).Next(servers); got != nil {
+		t.Errorf("Next = %s, want none", got.URL)
+	}
+	servers[4].Healthy = true
+	for range 100 {
+		if got := (powerOfTwoChoices{}).Next(servers); got != servers[4] {
+			t.Fatal("Next did not return the only healthy server")
+		}
+	}
+}
+
+// benchmarkNext measures the selections of b among n healthy servers.
+func TestLeastConnectionsLatency(t *testing.T) {
+	servers := testServers(t, 1, 1, 1)
+	busy, slow, down := servers[0], servers[1], servers[2]
+	down.Healthy = false
+	// The first server is selected while none has connections or latency.
+	if got := (leastConnectionsLatency{alpha: 0.5}).Next(servers); got != busy {
+		t.Errorf("Next without connections nor latencies = %v, want the first server", got.URL)
+	}
+
+	// The busy server is fast, the slow one idle: the selection shifts
+	// from the first to the second as alpha grows, the scores being equal
+	// at about 0.545.
+	busy.ActiveConnections, busy.LastCheck.Latency = 4, 10*time.Millisecond
+	slow.ActiveConnections, slow.LastCheck.Latency = 1, 100*time.Millisecond
+	down.LastCheck.Latency = time.Millisecond
+	for _, tt := range []struct {
+		alpha float64
+		want  *Server
+	}{
+		{0, busy},
+		{0.3, busy},
+		{0.5, busy},
+		{0.6, slow},
+		{0.8, slow},
+		{1, slow},
+	} {
+		if got := (leastConnectionsLatency{alpha: tt.alpha}).Next(servers); got != tt.want {
+			t.Errorf("Next with alpha %g = %s, want %s", tt.alpha, got.URL, tt.want.URL)
+		}
+	}
+
+	busy.Healthy, slow.Healthy = false, false
+	if got := (leastConnectionsLatency{alpha: 0.5}).Next(servers); got != nil {
+		t.Errorf("Next without healthy servers = %s, want none", got.URL)
+	}
+}
+
+func TestConnectionsLatencyAlpha(t *testing.T) {
+	pool := newTestState(t, `{
+		"servers": ["backend:8080"],
+		"algorithm": "least-connections-latency",
+		"connectionsLatencyAlpha": 0,
+		"disableHealthChecks": true
+	}`).Pools[defaultPoolName]
+	if b, ok := pool.Balancer.(leastConnectionsLatency); !ok || b.alpha != 0 {
+		t.Errorf("balancer %#v, want least-connections-latency with alpha 0", pool.Balancer)
+	}
+
+	for _, alpha := range []string{"-0.1", "1.5"} {
+		c, err := loadConfig(writeConfig(t, fmt.Sprintf(`{
+			"servers": ["backend:8080"],
+			"connectionsLatencyAlpha": %s,
+			"disableHealthChecks": true
+		}`, alpha)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newState(c); err == nil {
+			t.Errorf("connectionsLatencyAlpha %s accepted", alpha)
+		}
+	}
+}
+
+func benchmarkNext(bench *testing.B, b Balancer, n int) {
+	servers := testServers(bench, slices.Repeat([]int{1}, n)...)
+	for i, server := range servers {
+		server.ActiveConnections = i % 7
+	}
+	bench.ResetTimer()
+	for range bench.N {
+		b.Next(servers)
+	}
+}
+
+func BenchmarkLeastConnections(b *testing.B) {
+	for _, n := range []int{10, 1000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) { benchmarkNext(b, leastConnections{}, n) })
+	}
+}
+
+func BenchmarkPowerOfTwoChoices(b *testing.B) {
+	for _, n := range []int{10, 1000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) { benchmarkNext(b, powerOfTwoChoices{}, n) })
+	}
+}
+
+func TestWeightDecay(t *testing.T) {
+	d, err := newWeightDecay(&WeightDecayConfig{Decay: 0.5, Recovery: 0.25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := testServers(t, 1, 1)
+	server := servers[0]
+
+	for _, tt := range []struct {
+		failed bool
+		want   float64
+	}{
+		{true, 0.5},
+		{true, 0.25},
+		{false, 0.5},
+		{false, 0.75},
+		{false, 1},
+		{false, 1},
+	} {
+		d.Observe(server, tt.failed)
+		if server.WeightFactor != tt.want {
+			t.Errorf("weight factor after a response failed %v = %g, want %g", tt.failed, server.WeightFactor, tt.want)
+		}
+	}
+	for range 100 {
+		d.Observe(server, true)
+	}
+	if server.WeightFactor != minWeightFactor {
+		t.Errorf("weight factor after many errors = %g, want %g", server.WeightFactor, minWeightFactor)
+	}
+
+	// The decayed server gets less traffic until it recovers.
+	server.WeightFactor = 1
+	d.Observe(server, true)
+	d.Observe(server, true)
+	checkShares(t, shares(weightedRandom{}, servers, 100000), []float64{0.2, 0.8})
+	d.Observe(server, false)
+	checkShares(t, shares(weightedRandom{}, servers, 100000), []float64{1.0 / 3, 2.0 / 3})
+	d.Observe(server, false)
+	d.Observe(server, false)
+	checkShares(t, shares(weightedRandom{}, servers, 100000), []float64{0.5, 0.5})
+
+	for _, config := range []WeightDecayConfig{{0, 0.5}, {1, 0.5}, {0.5, 0}, {0.5, 1.5}} {
+		if _, err := newWeightDecay(&config); err == nil {
+			t.Errorf("newWeightDecay(%+v) succeeded", config)
+		}
+	}
+}
+
+func TestWeightDecayProxied(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}, {"url": %q}],
+		"algorithm": "weighted-random",
+		"errorWeightDecay": {"decay": 0.5, "recovery": 0.1},
+		"disableHealthChecks": true
+	}`, failingBackend(t, &failing), newBackend(t, func(w http.ResponseWriter, r *http.Request) {}).URL))
+	st := lb.State()
+	flaky := st.Servers[0]
+
+	// share returns the share of n requests the flaky server got.
+	share := func(n int) float64 {
+		before := flaky.Requests.Load()
+		for range n {
+			serve(lb, httptest.NewRequest("GET", "/", nil))
+		}
+		return float64(flaky.Requests.Load()-before) / float64(n)
+	}
+	if got := share(1000); got > 0.1 {
+		t.Errorf("failing server got %.3f of the requests, want its weight decayed", got)
+	}
+	failing.Store(false)
+	share(1000)
+	if got := share(1000); got < 0.45 || got > 0.55 {
+		t.Errorf("recovered server got %.3f of the requests, want 0.5", got)
+	}
+}
+
+// lastHealthy selects the last healthy server, counting its selections
+// and the notifications of the servers of its pool.
+type lastHealthy struct{ calls, changes *atomic.Int64 }
+
+func (b lastHealthy) OnServersChanged(servers []*Server) {
+	b.changes.Add(1)
+}
+
+func (b lastHealthy) Next(servers []*Server) *Server {
+	b.calls.Add(1)
+	for _, server := range slices.Backward(servers) {
+		if server.Healthy {
+			return server
+		}
+	}
+	return nil
+}
+
+func TestRegisterBalancer(t *testing.T) {
+	var created, calls, changes atomic.Int64
+	RegisterBalancer("last-healthy", func(BalancerOptions) Balancer {
+		created.Add(1)
+		return lastHealthy{&calls, &changes}
+	})
+	t.Cleanup(func() {
+		balancersMu.Lock()
+		delete(balancers, "last-healthy")
+		balancersMu.Unlock()
+	})
+
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	first, last := newBackend(t, handler), newBackend(t, handler)
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"pools": {"api": {"servers": [{"url": %q}, {"url": %q}], "algorithm": "last-healthy"}},
+		"routes": [{"pathPrefix": "/api", "pool": "api"}],
+		"disableHealthChecks": true
+	}`, first.URL, first.URL, last.URL))
+	if got := created.Load(); got != 1 {
+		t.Errorf("custom balancer created %d times, want once for the api pool", got)
+	}
+	if got := changes.Load(); got != 1 {
+		t.Errorf("custom balancer notified of %d server changes, want 1 when its pool was created", got)
+	}
+
+	for range 10 {
+		serve(lb, httptest.NewRequest("GET", "/api", nil))
+	}
+	if got := calls.Load(); got != 10 {
+		t.Errorf("custom balancer selected %d servers, want 10", got)
+	}
+	for _, server := range lb.State().Pools["api"].Servers {
+		want := int64(0)
+		if server.URL.Host == strings.TrimPrefix(last.URL, "http://") {
+			want = 10
+		}
+		if got := server.Requests.Load(); got != want {
+			t.Errorf("api server %s got %d requests, want %d", server.URL.Host, got, want)
+		}
+	}
+
+	if _, err := newBalancer("unregistered", BalancerOptions{}); err == nil {
+		t.Error("newBalancer with an unregistered algorithm succeeded")
+	}
+}
+
+// slowRebuild records the weight of the first server when notified of
+// its changes, as a ring would, slowly.
+type slowRebuild struct {
+	leastConnections
+	mu              *sync.Mutex
+	weight, overlap *int
+	active          *atomic.Int64
+}
+
+func (b slowRebuild) OnServersChanged(servers []*Server) {
+	if b.active.Add(1) > 1 {
+		b.mu.Lock()
+		*b.overlap++
+		b.mu.Unlock()
+	}
+	defer b.active.Add(-1)
+	servers[0].Mu.Lock()
+	weight := servers[0].Weight
+	servers[0].Mu.Unlock()
+	time.Sleep(time.Millisecond)
+	b.mu.Lock()
+	*b.weight = weight
+	b.mu.Unlock()
+}
+
+func TestServersChangedConcurrentWeights(t *testing.T) {
+	var mu sync.Mutex
+	var weight, overlap int
+	var active atomic.Int64
+	RegisterBalancer("slow-rebuild", func(BalancerOptions) Balancer {
+		return slowRebuild{mu: &mu, weight: &weight, overlap: &overlap, active: &active}
+	})
+	t.Cleanup(func() {
+		balancersMu.Lock()
+		delete(balancers, "slow-rebuild")
+		balancersMu.Unlock()
+	})
+	lb := newTestLoadBalancer(t, `{
+		"servers": ["backend-1:8080", "backend-2:8080"],
+		"algorithm": "slow-rebuild",
+		"disableHealthChecks": true
+	}`)
+	admin := newAdminHandler(&AdminConfig{}, lb)
+	server := lb.State().Servers[0]
+	path := "/admin/servers/" + url.PathEscape(server.URL.String()) + "/weight"
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(admin, httptest.NewRequest("POST", path, strings.NewReader(fmt.Sprintf(`{"weight": %d}`, i+1))))
+		}()
+	}
+	wg.Wait()
+
+	if overlap != 0 {
+		t.Errorf("balancer notified concurrently %d times, want never", overlap)
+	}
+	if weight != server.Weight {
+		t.Errorf("balancer last notified with the weight %d, want the last one set, %d", weight, server.Weight)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheEntryBytes is the largest response body that will be cached,
+// unless Config.MaxBufferBytes is set.
+const maxCacheEntryBytes = 1 << 20
+
+// cacheableStatusCodes contains the status codes that may be cached.
+var cacheableStatusCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// CacheConfig represents the response cache configuration.
+//
+// Identical concurrent requests missing the cache are coalesced: the
+// first one is proxied and the others wait for its response.
+type CacheConfig struct {
+	// Size is the maximum number of cached responses.
+	Size int `json:"size"`
+	// DefaultTTL is used when the backend response has no
+	// Cache-Control or Expires header.
+	DefaultTTL Duration `json:"defaultTTL"`
+}
+
+// cacheEntry represents a cached response.
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// write writes the cached response to w. The headers already set by the
+// load balancer, e.g. the request ID, are kept.
+func (e *cacheEntry) write(w http.ResponseWriter) {
+	for k, v := range e.header {
+		if _, ok := w.Header()[k]; !ok {
+			w.Header()[k] = v
+		}
+	}
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(e.status)
+	_, _ = w.Write(e.body)
+}
+
+// ResponseCache is an LRU cache of backend responses.
+type ResponseCache struct {
+	// Mu mutex for safe concurrency.
+	Mu *sync.Mutex
+
+	size       int
+	defaultTTL time.Duration
+	entries    map[string]*list.Element
+	lru        *list.List
+	flights    map[string]*cacheFlight
+}
+
+// cacheFlight represents a request fetching a response missing from the
+// cache, waited for by identical concurrent requests.
+type cacheFlight struct {
+	done chan struct{}
+	// entry is the response shared with the waiting requests once done
+	// is closed, nil if they must be proxied themselves.
+	entry *cacheEntry
+}
+
+// NewResponseCache returns a cache holding at most size responses.
+func NewResponseCache(size int, defaultTTL time.Duration) *ResponseCache {
+	return &ResponseCache{
+		Mu:         &sync.Mutex{},
+		size:       size,
+		defaultTTL: defaultTTL,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		flights:    make(map[string]*cacheFlight),
+	}
+}
+
+// Get returns the fresh entry stored under key, if any.
+func (c *ResponseCache) Get(key string) (*cacheEntry, bool) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	return entry, true
+}
+
+// Join returns the flight fetching the response stored under key, and
+// whether the caller leads it. The leader must call Finish.
+func (c *ResponseCache) Join(key string) (*cacheFlight, bool) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	if f, ok := c.flights[key]; ok {
+		return f, false
+	}
+	f := &cacheFlight{done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+// Finish ends the flight f of key, sharing entry with the requests
+// waiting for it.
+func (c *ResponseCache) Finish(key string, f *cacheFlight, entry *cacheEntry) {
+	c.Mu.Lock()
+	delete(c.flights, key)
+	c.Mu.Unlock()
+
+	f.entry = entry
+	close(f.done)
+}
+
+// Store caches the response captured by rec under key if the response
+// is cacheable, and returns the cached entry.
+func (c *ResponseCache) Store(key string, rec *cacheRecorder) *cacheEntry {
+	if rec.overflow || !cacheableStatusCodes[rec.status] {
+		return nil
+	}
+
+	ttl, ok := c.ttl(rec.header)
+	if !ok {
+		return nil
+	}
+
+	entry := &cacheEntry{
+		key:     key,
+		status:  rec.status,
+		header:  rec.header,
+		body:    rec.body.Bytes(),
+		expires: time.Now().Add(ttl),
+	}
+
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return entry
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	return entry
+}
+
+// ttl returns how long a response with the given header may be cached.
+//
+// Cache-Control takes precedence over Expires, and the default TTL is
+// used when neither is present.
+func (c *ResponseCache) ttl(header http.Header) (time.Duration, bool) {
+	if header.Get("Set-Cookie") != "" || header.Get("Vary") != "" || header.Get("Trailer") != "" {
+		return 0, false
+	}
+
+	if cc := header.Get("Cache-Control"); cc != "" {
+		var maxAge, sharedMaxAge = -1, -1
+		for _, directive := range strings.Split(cc, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache", "private":
+				return 0, false
+			case "max-age":
+				maxAge, _ = strconv.Atoi(value)
+			case "s-maxage":
+				sharedMaxAge, _ = strconv.Atoi(value)
+			}
+		}
+
+		if sharedMaxAge >= 0 {
+			maxAge = sharedMaxAge
+		}
+		if maxAge >= 0 {
+			return time.Duration(maxAge) * time.Second, maxAge > 0
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, false
+		}
+		ttl := time.Until(t)
+		return ttl, ttl > 0
+	}
+
+	return c.defaultTTL, c.defaultTTL > 0
+}
+
+// isCacheableRequest reports whether the response to r may be served
+// from or stored in the cache.
+func isCacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	cc := strings.ToLower(r.Header.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "no-cache")
+}
+
+// cacheKey returns the cache key for r.
+func cacheKey(r *http.Request) string {
+	return r.Method + " " + r.Host + r.URL.RequestURI()
+}
+
+// cacheRecorder is a http.ResponseWriter that copies the response
+// into memory while writing it to the client.
+type cacheRecorder struct {
+	http.ResponseWriter
+
+	maxBytes int64
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+// newCacheRecorder returns a cacheRecorder that writes to w, copying at
+// most maxBytes of body.
+func newCacheRecorder(w http.ResponseWriter, maxBytes int64) *cacheRecorder {
+	return &cacheRecorder{ResponseWriter: w, maxBytes: maxBytes}
+}
+
+// WriteHeader records the status code and a copy of the header.
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status == 0 && status >= http.StatusOK {
+		rec.status = status
+		rec.header = rec.Header().Clone()
+		rec.header.Del("X-Cache")
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write records b and writes it to the client.
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(b)) > rec.maxBytes {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying http.ResponseWriter.
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// storeResponse stores a response with the given header and body in c
+// under key.
+func storeResponse(c *ResponseCache, key string, header http.Header, body string) *cacheEntry {
+	rec := newCacheRecorder(httptest.NewRecorder(), maxCacheEntryBytes)
+	for k, v := range header {
+		rec.Header()[k] = v
+	}
+	rec.Write([]byte(body))
+	return c.Store(key, rec)
+}
+
+func TestCacheHitMiss(t *testing.T) {
+	var requests atomic.Int64
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, r.URL.Path)
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"cache": {"size": 10}
+	}`, backend.URL))
+
+	for _, tt := range []struct {
+		method, path, cache string
+		header              http.Header
+	}{
+		{"GET", "/a", "MISS", nil},
+		{"GET", "/a", "HIT", nil},
+		{"GET", "/b", "MISS", nil},
+		{"GET", "/a", "HIT", nil},
+		{"GET", "/a", "", http.Header{"Authorization": {"Bearer x"}}},
+		{"GET", "/a", "", http.Header{"Cache-Control": {"no-cache"}}},
+		{"POST", "/a", "", nil},
+	} {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		for k, v := range tt.header {
+			r.Header[k] = v
+		}
+		w := serve(lb, r)
+		if got := w.Header().Get("X-Cache"); got != tt.cache {
+			t.Errorf("%s %s %v: X-Cache = %q, want %q", tt.method, tt.path, tt.header, got, tt.cache)
+		}
+		if w.Code != http.StatusOK || w.Body.String() != tt.path {
+			t.Errorf("%s %s %v: %d %q, want 200 %q", tt.method, tt.path, tt.header, w.Code, w.Body, tt.path)
+		}
+	}
+	if n := requests.Load(); n != 5 {
+		t.Errorf("backend got %d requests, want 5", n)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := NewResponseCache(10, 50*time.Millisecond)
+	if storeResponse(c, "k", nil, "body") == nil {
+		t.Fatal("response with the default TTL not stored")
+	}
+	if entry, ok := c.Get("k"); !ok || string(entry.body) != "body" {
+		t.Fatalf("Get = %v, %v, want the stored entry", entry, ok)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.Get("k"); ok {
+		t.Error("expired entry returned")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := NewResponseCache(10, time.Minute)
+	for _, tt := range []struct {
+		header http.Header
+		ttl    time.Duration
+		ok     bool
+	}{
+		{http.Header{}, time.Minute, true},
+		{http.Header{"Cache-Control": {"max-age=30"}}, 30 * time.Second, true},
+		{http.Header{"Cache-Control": {"public, max-age=30, s-maxage=10"}}, 10 * time.Second, true},
+		{http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{http.Header{"Cache-Control": {"private, max-age=30"}}, 0, false},
+		{http.Header{"Expires": {"invalid"}}, 0, false},
+		{http.Header{"Expires": {time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}}, 0, false},
+		{http.Header{"Set-Cookie": {"a=b"}}, 0, false},
+		{http.Header{"Vary": {"Accept"}}, 0, false},
+	} {
+		ttl, ok := c.ttl(tt.header)
+		if ok != tt.ok || (ok && ttl != tt.ttl) {
+			t.Errorf("ttl(%v) = %s, %v, want %s, %v", tt.header, ttl, ok, tt.ttl, tt.ok)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := NewResponseCache(2, time.Minute)
+	storeResponse(c, "a", nil, "a")
+	storeResponse(c, "b", nil, "b")
+	// a is now the most recently used.
+	c.Get("a")
+	storeResponse(c, "c", nil, "c")
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.Get(key); ok != want {
+			t.Errorf("Get(%q) found %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		status       int
+		cacheControl string
+		requests     int64
+		cached       bool
+		cancelLeader bool
+	}{
+		{"cacheable", http.StatusOK, "max-age=60", 1, true, false},
+		// Errors are shared but not cached.
+		{"error", http.StatusInternalServerError, "", 1, false, false},
+		// The waiting requests are proxied themselves.
+		{"not cacheable", http.StatusOK, "no-store", 20, false, false},
+		// The cancellation of the first request is not shared.
+		{"canceled leader", http.StatusOK, "max-age=60", 20, true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			release := make(chan struct{})
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) == 1 {
+					select {
+					case <-release:
+					case <-r.Context().Done():
+						return
+					}
+				}
+				if tt.cacheControl != "" {
+					w.Header().Set("Cache-Control", tt.cacheControl)
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, "shared")
+			})
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}],
+				"disableHealthChecks": true,
+				"cache": {"size": 10}
+			}`, backend.URL))
+
+			type response struct {
+				code int
+				body string
+			}
+			// The first request leads the others.
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			led := make(chan response, 1)
+			go func() {
+				w := serve(lb, httptest.NewRequestWithContext(ctx, "GET", "/a", nil))
+				led <- response{w.Code, w.Body.String()}
+			}()
+			for requests.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			responses := make(chan response, 19)
+			for range 19 {
+				go func() {
+					w := serve(lb, httptest.NewRequest("GET", "/a", nil))
+					responses <- response{w.Code, w.Body.String()}
+				}()
+			}
+			// Let the other requests join the first one.
+			time.Sleep(50 * time.Millisecond)
+			if tt.cancelLeader {
+				cancel()
+				<-led
+			}
+			close(release)
+
+			if !tt.cancelLeader {
+				if res := <-led; res.code != tt.status || res.body != "shared" {
+					t.Errorf("first request got %d %q, want %d %q", res.code, res.body, tt.status, "shared")
+				}
+			}
+			for range 19 {
+				if res := <-responses; res.code != tt.status || res.body != "shared" {
+					t.Errorf("coalesced request got %d %q, want %d %q", res.code, res.body, tt.status, "shared")
+				}
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("backend got %d of 20 identical requests, want %d", got, tt.requests)
+			}
+
+			// Only cacheable responses are served from the cache afterwards.
+			serve(lb, httptest.NewRequest("GET", "/a", nil))
+			want := tt.requests
+			if !tt.cached {
+				want++
+			}
+			if got := requests.Load(); got != want {
+				t.Errorf("backend got %d requests after the coalesced ones, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// prefixSet is a set of IP prefixes.
+type prefixSet []netip.Prefix
+
+// parsePrefixes parses IPs and CIDRs, e.g. "10.0.0.1" or "10.0.0.0/8".
+func parsePrefixes(values []string) (prefixSet, error) {
+	var ps prefixSet
+	for _, value := range values {
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, err
+			}
+			ps = append(ps, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", value)
+		}
+		addr = addr.Unmap()
+		ps = append(ps, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return ps, nil
+}
+
+// Contains reports whether addr is in one of the prefixes.
+func (ps prefixSet) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range ps {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilter allows or denies clients by IP.
+type ipFilter struct {
+	allow prefixSet
+	deny  prefixSet
+}
+
+// newIPFilter returns the filter allowing the clients in allow, or all
+// of them if it is empty, except those in deny.
+func newIPFilter(allow, deny []string) (ipFilter, error) {
+	var f ipFilter
+	var err error
+	if f.allow, err = parsePrefixes(allow); err != nil {
+		return f, fmt.Errorf("parsing allowCIDRs: %w", err)
+	}
+	if f.deny, err = parsePrefixes(deny); err != nil {
+		return f, fmt.Errorf("parsing denyCIDRs: %w", err)
+	}
+	return f, nil
+}
+
+// Enabled reports whether the filter denies some clients.
+func (f ipFilter) Enabled() bool {
+	return len(f.allow) > 0 || len(f.deny) > 0
+}
+
+// Allows reports whether the client with the given IP is allowed. ok is
+// false when the IP of the client is unknown.
+func (f ipFilter) Allows(addr netip.Addr, ok bool) bool {
+	if !ok {
+		return len(f.allow) == 0
+	}
+	if f.deny.Contains(addr) {
+		return false
+	}
+	return len(f.allow) == 0 || f.allow.Contains(addr)
+}
+
+// clientIP returns the IP of the client of r. The X-Forwarded-For header
+// is used when the peer is one of trusted: the client is its rightmost
+// address that is not one of trusted.
+func clientIP(r *http.Request, trusted prefixSet) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if !trusted.Contains(addr) {
+		return addr, true
+	}
+
+	var forwarded []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// The addresses before a malformed one cannot be trusted.
+			break
+		}
+		addr = hop.Unmap()
+		if !trusted.Contains(addr) {
+			break
+		}
+	}
+	return addr, true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		allow, deny []string
+		addr        string
+		want        bool
+	}{
+		{"no rules", nil, nil, "203.0.113.7", true},
+		{"allowed IP", []string{"203.0.113.7"}, nil, "203.0.113.7", true},
+		{"allowed CIDR", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{"not allowed", []string{"10.0.0.0/8"}, nil, "192.168.0.1", false},
+		{"denied", nil, []string{"192.168.0.0/16"}, "192.168.0.1", false},
+		{"not denied", nil, []string{"192.168.0.0/16"}, "10.1.2.3", true},
+		{"deny takes precedence", []string{"10.0.0.0/8"}, []string{"10.0.0.5"}, "10.0.0.5", false},
+		{"unmasked CIDR", []string{"10.1.2.3/8"}, nil, "10.200.0.1", true},
+		{"IPv4-mapped IPv6", []string{"10.0.0.0/8"}, nil, "::ffff:10.1.2.3", true},
+		{"IPv6", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"IPv6 not allowed", []string{"2001:db8::/32"}, nil, "2001:db9::1", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newIPFilter(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Allows(netip.MustParseAddr(tt.addr), true); got != tt.want {
+				t.Errorf("Allows(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+
+	// Clients with an unknown IP are only allowed without an allow list.
+	for _, tt := range []struct {
+		allow, deny []string
+		want        bool
+	}{
+		{nil, []string{"10.0.0.0/8"}, true},
+		{[]string{"10.0.0.0/8"}, nil, false},
+	} {
+		f, err := newIPFilter(tt.allow, tt.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Allows(netip.Addr{}, false); got != tt.want {
+			t.Errorf("Allows(unknown) with allow %v and deny %v = %v, want %v", tt.allow, tt.deny, got, tt.want)
+		}
+	}
+}
+
+func TestNewIPFilter(t *testing.T) {
+	for _, tt := range []struct {
+		allow, deny []string
+		want        string
+	}{
+		{[]string{"10.0.0.0/33"}, nil, "parsing allowCIDRs"},
+		{nil, []string{"not-an-ip"}, "parsing denyCIDRs"},
+	} {
+		if _, err := newIPFilter(tt.allow, tt.deny); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("newIPFilter(%v, %v) = %v, want an error %q", tt.allow, tt.deny, err, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parsePrefixes([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name, remoteAddr string
+		forwarded        []string
+		want             string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted peer", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted peer", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted hops", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2", "10.0.0.3"}, "198.51.100.1"},
+		{"spoofed hop", "10.0.0.1:1234", []string{"192.0.2.66, 198.51.100.1"}, "198.51.100.1"},
+		{"malformed hop", "10.0.0.1:1234", []string{"198.51.100.1, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"no port", "203.0.113.7", nil, "203.0.113.7"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			got, ok := clientIP(r, trusted)
+			if !ok || got.String() != tt.want {
+				t.Errorf("clientIP = %s, %v, want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPFilterProxied(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"trustedProxies": ["10.0.0.1"],
+		"allowCIDRs": ["198.51.100.0/24"],
+		"denyCIDRs": ["198.51.100.66"],
+		"disableHealthChecks": true
+	}`, backend.URL))
+
+	for _, tt := range []struct {
+		remoteAddr, forwarded string
+		want                  int
+	}{
+		{"198.51.100.1:1234", "", http.StatusOK},
+		{"203.0.113.7:1234", "", http.StatusForbidden},
+		{"198.51.100.66:1234", "", http.StatusForbidden},
+		{"10.0.0.1:1234", "198.51.100.1", http.StatusOK},
+		{"10.0.0.1:1234", "203.0.113.7", http.StatusForbidden},
+		// A client cannot pretend to be allowed.
+		{"203.0.113.7:1234", "198.51.100.1", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if code := serve(lb, r).Code; code != tt.want {
+			t.Errorf("request from %s forwarded for %q got %d, want %d", tt.remoteAddr, tt.forwarded, code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// expiringConn is a connection to a server that is not reused once
+// expires is past.
+type expiringConn struct {
+	net.Conn
+	expires time.Time
+}
+
+// isExpiredConn reports whether conn, possibly wrapped by TLS, is an
+// expired expiringConn.
+func isExpiredConn(conn net.Conn) bool {
+	if tc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tc.NetConn()
+	}
+	ec, ok := conn.(*expiringConn)
+	return ok && time.Now().After(ec.expires)
+}
+
+// connLifetimeTransport recycles the HTTP/1 connections to the servers
+// once they are older than their lifetime, e.g. so that the new IPs
+// behind the host name of a server are used.
+//
+// An expired connection is closed after the request it is next used for,
+// sent with "Connection: close", so that no request is interrupted. Idle
+// connections are otherwise closed after IdleConnTimeout.
+type connLifetimeTransport struct {
+	*http.Transport
+}
+
+// newConnLifetimeTransport returns t, whose connections expire after
+// lifetime.
+func newConnLifetimeTransport(t *http.Transport, lifetime time.Duration) *connLifetimeTransport {
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &expiringConn{Conn: conn, expires: time.Now().Add(lifetime)}, nil
+	}
+	return &connLifetimeTransport{Transport: t}
+}
+
+// RoundTrip sends req, closing its connection afterwards if it expired.
+func (t *connLifetimeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The connection is only known once the transport got it, before the
+	// request is written. The transport copies the requests with a body,
+	// sharing their header, which is copied to be modified instead.
+	header := req.Header.Clone()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused && isExpiredConn(info.Conn) {
+				header.Set("Connection", "close")
+			}
+		},
+	}
+	out := req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	out.Header = header
+	return t.Transport.RoundTrip(out)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnLifetime(t *testing.T) {
+	const lifetime = 100 * time.Millisecond
+	type request struct {
+		addr  string
+		close bool
+	}
+	var mu sync.Mutex
+	var requests []request
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		requests = append(requests, request{r.RemoteAddr, r.Close})
+		mu.Unlock()
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"maxConnLifetime": %q,
+		"disableHealthChecks": true
+	}`, backend.URL, lifetime))
+
+	for _, method := range []string{"GET", "POST"} {
+		t.Run(method, func(t *testing.T) {
+			send := func() request {
+				t.Helper()
+				var body io.Reader
+				if method == "POST" {
+					body = strings.NewReader("body")
+				}
+				if w := serve(lb, httptest.NewRequest(method, "/", body)); w.Code != http.StatusOK {
+					t.Fatalf("request got %d, want 200", w.Code)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				return requests[len(requests)-1]
+			}
+
+			first := send()
+			if second := send(); second.addr != first.addr || second.close {
+				t.Errorf("request before the lifetime sent on %s with close %v, want on %s kept open", second.addr, second.close, first.addr)
+			}
+			time.Sleep(lifetime + 50*time.Millisecond)
+			// The expired connection is closed after its next request.
+			if expired := send(); expired.addr != first.addr || !expired.close {
+				t.Errorf("request after the lifetime sent on %s with close %v, want on %s then closed", expired.addr, expired.close, first.addr)
+			}
+			if next := send(); next.addr == first.addr || next.close {
+				t.Errorf("request after the recycling sent on %s with close %v, want on a new connection", next.addr, next.close)
+			}
+		})
+	}
+}
+
+func TestConnLifetimeTransport(t *testing.T) {
+	rt := newTransport(Config{MaxConnsPerHost: 4, MaxConnLifetime: Duration(time.Minute)})
+	transport, ok := rt.(*connLifetimeTransport)
+	if !ok {
+		t.Fatalf("transport %T with a lifetime, want a connLifetimeTransport", rt)
+	}
+	if transport.MaxConnsPerHost != 4 {
+		t.Errorf("MaxConnsPerHost = %d, want 4", transport.MaxConnsPerHost)
+	}
+	if _, ok := newTransport(Config{}).(*http.Transport); !ok {
+		t.Error("transport without a lifetime wrapped")
+	}
+	if sameTransportConfig(Config{MaxConnLifetime: Duration(time.Minute)}, Config{}) {
+		t.Error("transports with different lifetimes reported the same")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// serverDrain represents the gradual drain of a server, whose share of
+// its traffic linearly decreases from 1 to 0 over duration.
+type serverDrain struct {
+	start    time.Time
+	duration time.Duration
+}
+
+// share returns the share of its traffic the server receives at now.
+func (d *serverDrain) share(now time.Time) float64 {
+	if d == nil {
+		return 1
+	}
+	elapsed := now.Sub(d.start)
+	if elapsed >= d.duration {
+		return 0
+	}
+	return 1 - float64(elapsed)/float64(d.duration)
+}
+
+// skipDraining returns servers without the draining servers skipped for
+// a request, each with a probability of one minus its share, and without
+// the drained servers.
+func skipDraining(servers []*Server) []*Server {
+	now := time.Now()
+	return slices.DeleteFunc(slices.Clone(servers), func(s *Server) bool {
+		s.Mu.Lock()
+		share := s.Drain.share(now)
+		s.Mu.Unlock()
+		return share < 1 && rand.Float64() >= share
+	})
+}
+
+// skipDrained returns servers without the drained servers.
+func skipDrained(servers []*Server) []*Server {
+	now := time.Now()
+	return slices.DeleteFunc(slices.Clone(servers), func(s *Server) bool {
+		s.Mu.Lock()
+		defer s.Mu.Unlock()
+		return s.Drain.share(now) == 0
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServerDrainShare(t *testing.T) {
+	start := time.Now()
+	d := &serverDrain{start: start, duration: time.Minute}
+	for _, tt := range []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 1},
+		{15 * time.Second, 0.75},
+		{30 * time.Second, 0.5},
+		{time.Minute, 0},
+		{time.Hour, 0},
+	} {
+		if got := d.share(start.Add(tt.elapsed)); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("share after %s = %g, want %g", tt.elapsed, got, tt.want)
+		}
+	}
+	if got := (*serverDrain)(nil).share(start); got != 1 {
+		t.Errorf("share without drain = %g, want 1", got)
+	}
+}
+
+func TestDrainTraffic(t *testing.T) {
+	st := newTestState(t, `{
+		"servers": ["a:80", "b:80"],
+		"algorithm": "weighted-random",
+		"disableHealthChecks": true
+	}`)
+	pool := st.Pools[defaultPoolName]
+	drained := st.Servers[0]
+
+	// The drained server gets its share of the half of the traffic it
+	// gets undrained.
+	const n = 10000
+	for _, share := range []float64{1, 0.75, 0.5, 0.25, 0} {
+		t.Run(fmt.Sprint(share), func(t *testing.T) {
+			duration := time.Hour
+			drained.Drain = &serverDrain{start: time.Now().Add(-time.Duration((1 - share) * float64(duration))), duration: duration}
+			count := 0
+			for range n {
+				if st.nextServer(pool, nil, "") == drained {
+					count++
+				}
+			}
+			if got, want := float64(count)/n, share/2; math.Abs(got-want) > 0.03 {
+				t.Errorf("drained server got %.3f of the traffic, want %.3f", got, want)
+			}
+		})
+	}
+}
+
+func TestDrainAll(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true
+	}`, backend.URL))
+	admin := newAdminHandler(&AdminConfig{}, lb)
+
+	// drain posts to path and returns the status it reports.
+	drain := func(path string) drainStatus {
+		w := serve(admin, httptest.NewRequest("POST", path, nil))
+		var status drainStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("%s: %d %s", path, w.Code, w.Body)
+		}
+		return status
+	}
+
+	inFlight := make(chan int, 1)
+	go func() {
+		inFlight <- serve(lb, httptest.NewRequest("GET", "/slow", nil)).Code
+	}()
+	<-started
+
+	if status := drain("/admin/drain-all"); !status.Drained || status.InFlight != 1 {
+		t.Errorf("drain-all reported %+v, want drained with 1 request in flight", status)
+	}
+	if code := serve(lb, httptest.NewRequest("GET", "/", nil)).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("new request while drained got %d, want 503", code)
+	}
+	if code := serve(admin, httptest.NewRequest("GET", "/readyz", nil)).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("readiness while drained: %d, want 503", code)
+	}
+	close(release)
+	if code := <-inFlight; code != http.StatusOK {
+		t.Errorf("request in flight when drained got %d, want 200", code)
+	}
+
+	if status := drain("/admin/undrain-all"); status.Drained || status.InFlight != 0 {
+		t.Errorf("undrain-all reported %+v, want undrained with no request in flight", status)
+	}
+	if code := serve(lb, httptest.NewRequest("GET", "/", nil)).Code; code != http.StatusOK {
+		t.Errorf("request after undrain-all got %d, want 200", code)
+	}
+	if code := serve(admin, httptest.NewRequest("GET", "/readyz", nil)).Code; code != http.StatusOK {
+		t.Errorf("readiness after undrain-all: %d, want 200", code)
+	}
+	if got := lb.State().Servers[0].Requests.Load(); got != 2 {
+		t.Errorf("server got %d requests, want 2", got)
+	}
+}
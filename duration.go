@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Duration is a duration in the configuration, either a string parsed by
+// time.ParseDuration, e.g. "10s", or a number of seconds, e.g. 10 or 0.5.
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string or a number of seconds.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(v)
+		return nil
+	}
+
+	var seconds float64
+	if err := json.Unmarshal(b, &seconds); err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string like \"10s\" or a number of seconds", b)
+	}
+	v := seconds * float64(time.Second)
+	if math.IsNaN(v) || v > math.MaxInt64 || v < math.MinInt64 {
+		return fmt.Errorf("invalid duration %s, out of range", b)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON formats the duration as a string, e.g. "1m30s".
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
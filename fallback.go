@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// FallbackConfig represents the configuration of the response served
+// when a pool has no healthy server.
+type FallbackConfig struct {
+	// File containing the body of the response, e.g. an HTML page. Its
+	// content type is inferred from its extension.
+	File string `json:"file"`
+	// Status code of the response, defaults to 503.
+	Status int `json:"status"`
+}
+
+// staticResponse is a response served without contacting a server.
+type staticResponse struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// newFallback returns the fallback response described by config, or nil
+// if there is none.
+func newFallback(config *FallbackConfig) (*staticResponse, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	status := config.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	if status < 200 || status > 599 {
+		return nil, fmt.Errorf("parsing fallback.status: invalid status code %d", status)
+	}
+	body, err := os.ReadFile(config.File)
+	if err != nil {
+		return nil, fmt.Errorf("parsing fallback.file: %w", err)
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(config.File))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return &staticResponse{status: status, contentType: contentType, body: body}, nil
+}
+
+// ServeHTTP writes the response.
+func (s *staticResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", s.contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(s.status)
+	if r.Method != http.MethodHead {
+		w.Write(s.body)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFallback(t *testing.T) {
+	const page = "<h1>Back soon</h1>"
+	file := filepath.Join(t.TempDir(), "down.html")
+	if err := os.WriteFile(file, []byte(page), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var failing atomic.Bool
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"fallback": {"file": %q},
+		"healthCheckInterval": "1h"
+	}`, failingBackend(t, &failing), file))
+	st := lb.State()
+
+	failing.Store(true)
+	st.healthChecker.UpdateAll(t.Context(), st.Servers)
+	w := serve(lb, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != page {
+		t.Errorf("request with all servers down got %d %q, want 503 %q", w.Code, w.Body, page)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("fallback Content-Type = %q, want text/html; charset=utf-8", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("fallback Cache-Control = %q, want no-store", got)
+	}
+	if w := serve(lb, httptest.NewRequest("HEAD", "/", nil)); w.Code != http.StatusServiceUnavailable || w.Body.Len() != 0 {
+		t.Errorf("HEAD request with all servers down got %d with %d bytes, want 503 without body", w.Code, w.Body.Len())
+	}
+	if got := st.Servers[0].Requests.Load(); got != 0 {
+		t.Errorf("server down got %d requests, want none", got)
+	}
+
+	failing.Store(false)
+	st.healthChecker.UpdateAll(t.Context(), st.Servers)
+	if w := serve(lb, httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusOK || w.Body.String() == page {
+		t.Errorf("request after the recovery got %d %q, want proxied", w.Code, w.Body)
+	}
+}
+
+func TestNewFallback(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "down")
+	if err := os.WriteFile(file, []byte("down\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newFallback(&FallbackConfig{File: file, Status: http.StatusOK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The content type is detected without an extension.
+	if s.status != http.StatusOK || s.contentType != "text/plain; charset=utf-8" {
+		t.Errorf("fallback with status %d and content type %q, want 200 and text/plain", s.status, s.contentType)
+	}
+
+	for _, config := range []FallbackConfig{
+		{File: file, Status: 99},
+		{File: file, Status: 600},
+		{File: filepath.Join(t.TempDir(), "missing.html")},
+	} {
+		if _, err := newFallback(&config); err == nil {
+			t.Errorf("newFallback(%+v) succeeded", config)
+		}
+	}
+}
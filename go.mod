@@ -1,3 +1,3 @@
 module goloadbalancer
 
-go 1.22
+go 1.24
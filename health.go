@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultHealthCheckUserAgent is the User-Agent of the HTTP health
+// checks when none is configured.
+const defaultHealthCheckUserAgent = "goloadbalancer-health-check"
+
+// maxHealthCheckBodyBytes is the maximum number of bytes read from a
+// health check response body.
+const maxHealthCheckBodyBytes = 64 << 10
+
+// Health check schedules, spreading the checks of the servers over the
+// interval.
+const (
+	// scheduleSimultaneous checks all servers at the same time.
+	scheduleSimultaneous = "simultaneous"
+	// scheduleStaggered checks server i of n at offset i*interval/n.
+	scheduleStaggered = "staggered"
+	// scheduleJitter checks each server at a random offset.
+	scheduleJitter = "jitter"
+)
+
+// Redirect policies of the HTTP health checks.
+const (
+	// redirectsFollow follows all redirects.
+	redirectsFollow = "follow"
+	// redirectsSameHost follows redirects to the same host only,
+	// evaluating the others.
+	redirectsSameHost = "same-host"
+	// redirectsNone evaluates all redirects.
+	redirectsNone = "none"
+)
+
+// Actions taken on servers whose health checks exceed the maximum
+// latency.
+const (
+	// slowDegrade keeps the server healthy but marks it degraded.
+	slowDegrade = "degrade"
+	// slowUnhealthy marks the server unhealthy.
+	slowUnhealthy = "unhealthy"
+)
+
+// Health check types.
+const (
+	// checkHTTP makes an HTTP request, GET by default.
+	checkHTTP = "http"
+	// checkTCP opens a TCP connection.
+	checkTCP = "tcp"
+)
+
+// CheckConfig represents the configuration of a health check of a server.
+type CheckConfig struct {
+	// Type of the check, "http" (default) or "tcp".
+	Type string `json:"type"`
+	// Path requested by HTTP checks, defaults to the path of the health
+	// check URL of the server.
+	Path string `json:"path"`
+	// Address connected to by TCP checks, defaults to the host and port
+	// of the health check URL of the server.
+	Address string `json:"address"`
+	// Timeout of the check, none by default.
+	Timeout Duration `json:"timeout"`
+}
+
+// healthCheck represents a health check of a server.
+type healthCheck struct {
+	// typ is checkHTTP or checkTCP.
+	typ string
+	// target is the URL of HTTP checks or the address of TCP checks.
+	target string
+	// name is target with its user information redacted.
+	name    string
+	timeout time.Duration
+}
+
+// newHealthChecks returns the health checks of the server with health
+// check URL u described by configs.
+func newHealthChecks(u *url.URL, configs []CheckConfig) ([]healthCheck, error) {
+	var checks []healthCheck
+	for i, config := range configs {
+		check := healthCheck{typ: config.Type}
+		check.timeout = time.Duration(config.Timeout)
+		if check.timeout < 0 {
+			return nil, fmt.Errorf("parsing servers: check %d of %s: timeout must not be negative", i, redactUserinfo(u))
+		}
+
+		switch config.Type {
+		case "", checkHTTP:
+			check.typ = checkHTTP
+			target := *u
+			if config.Path != "" {
+				target.Path = config.Path
+			}
+			check.target = target.String()
+			check.name = redactUserinfo(&target)
+		case checkTCP:
+			check.target = config.Address
+			if check.target == "" {
+				port := u.Port()
+				if port == "" {
+					port = "80"
+					if u.Scheme == "https" {
+						port = "443"
+					}
+				}
+				check.target = net.JoinHostPort(u.Hostname(), port)
+			}
+			check.name = check.target
+		default:
+			return nil, fmt.Errorf("parsing servers: check %d of %s has unknown type %q", i, redactUserinfo(u), config.Type)
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// StartupCheckConfig represents the configuration of the health check
+// of all servers at startup.
+type StartupCheckConfig struct {
+	// Timeout of the whole check.
+	Timeout Duration `json:"timeout"`
+	// RequireHealthy fails startup if no server is healthy.
+	RequireHealthy bool `json:"requireHealthy"`
+}
+
+// ReadinessCheckConfig represents the configuration of the health check
+// of all servers made by the readiness probe.
+type ReadinessCheckConfig struct {
+	// Quorum is the fraction of the servers that must be healthy,
+	// defaults to 1.
+	Quorum float64 `json:"quorum"`
+	// Timeout of the whole check, defaults to 5s.
+	Timeout Duration `json:"timeout"`
+}
+
+// readinessCheck checks that a quorum of servers is healthy.
+type readinessCheck struct {
+	quorum  float64
+	timeout time.Duration
+}
+
+// newReadinessCheck returns the readiness check described by config, or
+// nil if there is none.
+func newReadinessCheck(config *ReadinessCheckConfig) (*readinessCheck, error) {
+	if config == nil {
+		return nil, nil
+	}
+	quorum := config.Quorum
+	if quorum == 0 {
+		quorum = 1
+	}
+	if quorum < 0 || quorum > 1 {
+		return nil, fmt.Errorf("parsing readinessCheck.quorum: must be between 0 and 1")
+	}
+	timeout := time.Duration(config.Timeout)
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	if timeout < 0 {
+		return nil, fmt.Errorf("parsing readinessCheck.timeout: must not be negative")
+	}
+	return &readinessCheck{quorum: quorum, timeout: timeout}, nil
+}
+
+// Run checks the health of servers with hc and reports whether a quorum
+// of them is healthy, along with the number of healthy servers.
+func (rc *readinessCheck) Run(ctx context.Context, hc *HealthChecker, servers []*Server) (bool, int) {
+	ctx, cancel := context.WithTimeout(ctx, rc.timeout)
+	defer cancel()
+
+	healthy := hc.UpdateAll(ctx, servers)
+	return float64(healthy) >= math.Ceil(rc.quorum*float64(len(servers))), healthy
+}
+
+// HealthChecker periodically checks the health of servers.
+type HealthChecker struct {
+	// Interval between two health checks of a server.
+	Interval time.Duration
+	// StableInterval, if set, replaces Interval for servers whose last
+	// StableAfter checks had the same result.
+	StableInterval time.Duration
+	StableAfter    int
+	// Schedule of the health checks, e.g. scheduleStaggered.
+	Schedule string
+	// BodyContains, if set, must be contained in the response body
+	// for a server to be healthy.
+	BodyContains string
+	// LoadHeader is the response header reporting the load of a server.
+	LoadHeader string
+	// LoadField is the field of the JSON response body reporting the
+	// load of a server.
+	LoadField string
+	// CertExpiryWarning logs a warning when the TLS certificate of a
+	// server expires within it, if set.
+	CertExpiryWarning time.Duration
+	// UseServerTransport makes HTTP checks through the transport of the
+	// server, sharing its connections with the proxied requests.
+	UseServerTransport bool
+	// Redirects is the redirect policy of HTTP checks.
+	Redirects string
+	// Method of HTTP checks.
+	Method string
+	// UserAgent of HTTP checks.
+	UserAgent string
+	// Dialer opens the connections of the checks, net.Dialer{} when nil.
+	Dialer *net.Dialer
+	// Transport makes HTTP checks, http.DefaultTransport when nil.
+	Transport http.RoundTripper
+	// MaxLatency, if set, is the latency above which a passed check
+	// takes SlowAction, e.g. slowDegrade.
+	MaxLatency time.Duration
+	SlowAction string
+	// OnChange, if set, is called after a server became healthy or
+	// unhealthy.
+	OnChange func()
+	// Observe, if set, is called with the result of each check of a
+	// server.
+	Observe func(s *Server, result checkResult)
+}
+
+// Offset returns the delay before the first health check of server i
+// of n, according to the schedule.
+func (hc *HealthChecker) Offset(i, n int) time.Duration {
+	switch hc.Schedule {
+	case scheduleStaggered:
+		return hc.Interval * time.Duration(i) / time.Duration(n)
+	case scheduleJitter:
+		return rand.N(hc.Interval)
+	default:
+		return 0
+	}
+}
+
+// Run checks the health of s every Interval, or StableInterval once it
+// is stable, starting after offset, until stop is closed.
+func (hc *HealthChecker) Run(s *Server, offset time.Duration, stop <-chan struct{}) {
+	setNextCheck(s, offset+hc.Interval)
+	select {
+	case <-stop:
+		return
+	case <-time.After(offset):
+	}
+
+	timer := time.NewTimer(hc.Interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		// A server that never answers must not block its next checks.
+		ctx, cancel := context.WithTimeout(context.Background(), hc.checkTimeout(s))
+		hc.Update(ctx, s)
+		cancel()
+		next := hc.NextInterval(s)
+		setNextCheck(s, next)
+		timer.Reset(next)
+	}
+}
+
+// checkTimeout returns the deadline of a scheduled health check of s:
+// Interval, or the longest timeout of its checks if greater.
+func (hc *HealthChecker) checkTimeout(s *Server) time.Duration {
+	timeout := hc.Interval
+	for _, check := range s.Checks {
+		timeout = max(timeout, check.timeout)
+	}
+	return timeout
+}
+
+// setNextCheck records that the next scheduled health check of s is in d.
+func setNextCheck(s *Server, d time.Duration) {
+	s.Mu.Lock()
+	s.NextCheck = time.Now().Add(d)
+	s.Mu.Unlock()
+}
+
+// NextInterval returns the delay before the next health check of s.
+func (hc *HealthChecker) NextInterval(s *Server) time.Duration {
+	s.lockChecks(context.Background())
+	defer s.unlockChecks()
+
+	if hc.StableInterval > 0 && s.checkStreak >= hc.StableAfter {
+		return hc.StableInterval
+	}
+	return hc.Interval
+}
+
+// Update checks the health of s and records the result.
+//
+// Concurrent updates of the same server are serialized. If ctx ends while
+// waiting for another update, the health last recorded is returned.
+func (hc *HealthChecker) Update(ctx context.Context, s *Server) bool {
+	if !s.lockChecks(ctx) {
+		s.Mu.Lock()
+		defer s.Mu.Unlock()
+		return s.Healthy
+	}
+	defer s.unlockChecks()
+
+	start := time.Now()
+	result := hc.Check(ctx, s)
+	result.Time = start
+	result.Latency = time.Since(start)
+	if result.Healthy && hc.MaxLatency > 0 && result.Latency > hc.MaxLatency {
+		if hc.SlowAction == slowUnhealthy {
+			result.Healthy = false
+			result.Error = fmt.Sprintf("latency %s exceeds %s", result.Latency, hc.MaxLatency)
+		} else {
+			result.Degraded = true
+		}
+	}
+
+	if hc.Observe != nil {
+		hc.Observe(s, result)
+	}
+
+	s.Mu.Lock()
+	previousExpiry := s.LastCheck.CertExpiry
+	wasDegraded := s.LastCheck.Degraded
+	// Servers stay healthy during their grace period, until they pass a
+	// check.
+	inGrace := !result.Healthy && s.Healthy && start.Before(s.GraceUntil)
+	if result.Healthy {
+		s.GraceUntil = time.Time{}
+	}
+	changed := result.Healthy != s.Healthy && !inGrace
+	if changed {
+		s.checkStreak = 1
+	} else {
+		s.checkStreak++
+	}
+	if result.Healthy && changed && !s.LastCheck.Time.IsZero() {
+		s.HealthySince = start
+	}
+	if !inGrace {
+		s.Healthy = result.Healthy
+	}
+	s.LastCheck = result
+	s.Mu.Unlock()
+
+	switch {
+	case inGrace:
+		slog.Debug("Ignoring failed health check during the grace period", "server", s.RedactedURL(),
+			"statusCode", result.StatusCode, "error", result.Error)
+	case changed && result.Healthy:
+		slog.Info("Server became healthy", "server", s.RedactedURL())
+	case changed:
+		slog.Warn("Server became unhealthy", "server", s.RedactedURL(),
+			"statusCode", result.StatusCode, "error", result.Error)
+	case result.Degraded && !wasDegraded:
+		slog.Warn("Server became degraded", "server", s.RedactedURL(), "latency", result.Latency)
+	case wasDegraded && !result.Degraded && result.Healthy:
+		slog.Info("Server is no longer degraded", "server", s.RedactedURL())
+	}
+	if changed && hc.OnChange != nil {
+		hc.OnChange()
+	}
+
+	// Warn once per certificate.
+	if hc.CertExpiryWarning > 0 && !result.CertExpiry.IsZero() && !result.CertExpiry.Equal(previousExpiry) &&
+		time.Until(result.CertExpiry) < hc.CertExpiryWarning {
+		slog.Warn("Server certificate expires soon", "server", s.RedactedURL(),
+			"expiry", result.CertExpiry, "days", int(time.Until(result.CertExpiry).Hours()/24))
+	}
+
+	return result.Healthy
+}
+
+// checkResult represents the outcome of a health check.
+type checkResult struct {
+	// Healthy is true if the server passed the check.
+	Healthy bool
+	// Time the check started at.
+	Time time.Time
+	// Latency of the check.
+	Latency time.Duration
+	// Degraded is true if the server passed the check but exceeded the
+	// maximum latency.
+	Degraded bool
+	// StatusCode of the response, zero if there was none.
+	StatusCode int
+	// Error explaining why the check failed, if it did.
+	Error string
+	// Load reported by the server, valid if LoadKnown is true.
+	Load      float64
+	LoadKnown bool
+	// CertExpiry is the earliest expiry of the TLS certificates of the
+	// server, zero if it does not use TLS.
+	CertExpiry time.Time
+}
+
+// Check runs the health checks of s concurrently and reports whether it
+// passed all of them, along with the load it reports.
+//
+// A server without configured checks is checked with an HTTP request
+// to its health check URL.
+func (hc *HealthChecker) Check(ctx context.Context, s *Server) checkResult {
+	if len(s.Checks) == 0 {
+		return hc.checkHTTP(ctx, s, s.HealthCheckURL.String())
+	}
+
+	results := make([]checkResult, len(s.Checks))
+	var wg sync.WaitGroup
+	for i, check := range s.Checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := ctx
+			if check.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, check.timeout)
+				defer cancel()
+			}
+			if check.typ == checkTCP {
+				results[i] = hc.checkTCP(ctx, check.target)
+			} else {
+				results[i] = hc.checkHTTP(ctx, s, check.target)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The details of the response come from the first HTTP check.
+	result := checkResult{Healthy: true}
+	for i, r := range results {
+		check := s.Checks[i]
+		if check.typ == checkHTTP && result.StatusCode == 0 {
+			result.StatusCode = r.StatusCode
+			result.Load, result.LoadKnown = r.Load, r.LoadKnown
+			result.CertExpiry = r.CertExpiry
+		}
+		if !r.Healthy && result.Healthy {
+			result.Healthy = false
+			result.Error = fmt.Sprintf("%s check of %s: %s", check.typ, check.name, r.Error)
+		}
+	}
+	return result
+}
+
+// checkTCP reports whether a TCP connection to address can be opened.
+func (hc *HealthChecker) checkTCP(ctx context.Context, address string) checkResult {
+	d := hc.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return checkResult{Error: err.Error()}
+	}
+	if err := conn.Close(); err != nil {
+		slog.Error("Error closing connection", "error", err)
+	}
+	return checkResult{Healthy: true}
+}
+
+// checkRedirect implements the redirect policy of HTTP checks. The
+// redirect response is evaluated when it is not followed.
+func (hc *HealthChecker) checkRedirect(req *http.Request, via []*http.Request) error {
+	switch {
+	case hc.Redirects == redirectsNone:
+		return http.ErrUseLastResponse
+	case hc.Redirects == redirectsSameHost && !sameHost(req.URL, via[0].URL):
+		return http.ErrUseLastResponse
+	case len(via) >= 10:
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// sameHost reports whether a and b have the same host, ignoring the
+// default ports of their schemes.
+func sameHost(a, b *url.URL) bool {
+	return strings.EqualFold(stripDefaultPort(a.Scheme, a.Host), stripDefaultPort(b.Scheme, b.Host))
+}
+
+// checkHTTP makes an HTTP request to rawURL for s and reports whether
+// the response is healthy, along with the load it reports.
+func (hc *HealthChecker) checkHTTP(ctx context.Context, s *Server, rawURL string) checkResult {
+	req, err := http.NewRequestWithContext(ctx, hc.Method, rawURL, nil)
+	if err != nil {
+		return checkResult{Error: err.Error()}
+	}
+	req.Header.Set("User-Agent", hc.UserAgent)
+	client := &http.Client{Transport: hc.Transport, CheckRedirect: hc.checkRedirect}
+	if hc.UseServerTransport {
+		client.Transport = s.Transport
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return checkResult{Error: err.Error()}
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			slog.Error("Error closing response body", "error", err)
+		}
+	}()
+
+	result := checkResult{StatusCode: res.StatusCode}
+	if res.TLS != nil {
+		for _, cert := range res.TLS.PeerCertificates {
+			if result.CertExpiry.IsZero() || cert.NotAfter.Before(result.CertExpiry) {
+				result.CertExpiry = cert.NotAfter
+			}
+		}
+	}
+
+	// If status code is 5xx.
+	if res.StatusCode >= 500 {
+		result.Error = "unhealthy status code"
+		return result
+	}
+
+	var body []byte
+	if hc.BodyContains != "" || hc.LoadField != "" {
+		body, err = io.ReadAll(io.LimitReader(res.Body, maxHealthCheckBodyBytes))
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	if hc.BodyContains != "" && !bytes.Contains(body, []byte(hc.BodyContains)) {
+		result.Error = fmt.Sprintf("body does not contain %q", hc.BodyContains)
+		return result
+	}
+
+	result.Healthy = true
+	result.Load, result.LoadKnown = hc.load(res.Header, body)
+	return result
+}
+
+// load returns the load reported in a health check response, if any.
+//
+// The header takes precedence over the JSON body field. Negative or
+// invalid values are ignored.
+func (hc *HealthChecker) load(header http.Header, body []byte) (float64, bool) {
+	if hc.LoadHeader != "" {
+		if v, err := strconv.ParseFloat(header.Get(hc.LoadHeader), 64); err == nil && v >= 0 {
+			return v, true
+		}
+	}
+	if hc.LoadField != "" {
+		var fields map[string]any
+		if json.Unmarshal(body, &fields) == nil {
+			if v, ok := fields[hc.LoadField].(float64); ok && v >= 0 {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// countHealthy returns the number of healthy servers.
+func countHealthy(servers []*Server) int {
+	n := 0
+	for _, s := range servers {
+		s.Mu.Lock()
+		if s.Healthy {
+			n++
+		}
+		s.Mu.Unlock()
+	}
+	return n
+}
+
+// SelfTest checks the health of servers once, records the results and
+// logs a summary. It returns the number of healthy servers.
+func (hc *HealthChecker) SelfTest(ctx context.Context, servers []*Server) int {
+	// Unhealthy servers are logged by Update.
+	n := hc.UpdateAll(ctx, servers)
+	slog.Info("Startup check done", "healthy", n, "servers", len(servers))
+	return n
+}
+
+// UpdateAll checks the health of servers concurrently and records the
+// results. It returns the number of healthy servers.
+func (hc *HealthChecker) UpdateAll(ctx context.Context, servers []*Server) int {
+	healthy := make([]bool, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			healthy[i] = hc.Update(ctx, server)
+		}()
+	}
+	wg.Wait()
+
+	n := 0
+	for _, ok := range healthy {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
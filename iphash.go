@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// ringReplicas is the number of points of a server on the hash ring, per
+// unit of weight for weighted-ip-hash.
+const ringReplicas = 100
+
+// keyedBalancer is a Balancer selecting the server of a request by a
+// key, e.g. the IP of the client.
+type keyedBalancer interface {
+	Balancer
+	// NextKey returns the server of key, or nil if no server is available.
+	NextKey(servers []*Server, key string) *Server
+}
+
+// nextServerByKey returns the next of servers according to b, selected
+// by key if b is a keyedBalancer.
+func nextServerByKey(b Balancer, servers []*Server, key string) *Server {
+	if kb, ok := b.(keyedBalancer); ok {
+		return kb.NextKey(servers, key)
+	}
+	return b.Next(servers)
+}
+
+// ipHash selects the server of a client IP on a consistent hash ring, so
+// that a client keeps the same server and adding or removing a server
+// only remaps the clients of that server.
+//
+// The clients of an unavailable server go to the next server on the ring.
+// With weighted true, servers occupy a share of the ring proportional to
+// their weight.
+type ipHash struct {
+	weighted bool
+
+	mu *sync.Mutex
+	// ring is nil until the servers of the pool are known.
+	ring *hashRing
+}
+
+// newIPHash returns an ipHash, weighted or not.
+func newIPHash(weighted bool) *ipHash {
+	return &ipHash{weighted: weighted, mu: &sync.Mutex{}}
+}
+
+// OnServersChanged replaces the ring with the one of servers, with their
+// current weights.
+func (h *ipHash) OnServersChanged(servers []*Server) {
+	ring := newHashRing(servers, h.weighted)
+	h.mu.Lock()
+	h.ring = ring
+	h.mu.Unlock()
+}
+
+// Next returns the healthy server with the least active connections, as
+// no key is given.
+func (h *ipHash) Next(servers []*Server) *Server {
+	return nextServerLeastActive(servers)
+}
+
+// NextKey returns the first available of servers after the hash of key
+// on the ring of the pool, so that excluding a server, e.g. one already
+// tried, only moves its own clients.
+func (h *ipHash) NextKey(servers []*Server, key string) *Server {
+	h.mu.Lock()
+	ring := h.ring
+	h.mu.Unlock()
+	if ring == nil {
+		ring = newHashRing(servers, h.weighted)
+	}
+	if len(ring.points) == 0 {
+		return nil
+	}
+
+	allowed := make(map[*Server]bool, len(servers))
+	for _, server := range servers {
+		allowed[server] = true
+	}
+
+	point := ringHash(key)
+	i, _ := slices.BinarySearchFunc(ring.points, point, func(p ringPoint, target uint64) int {
+		return cmp.Compare(p.hash, target)
+	})
+
+	// Each server is only checked once.
+	checked := make(map[*Server]bool, ring.servers)
+	for j := range ring.points {
+		server := ring.points[(i+j)%len(ring.points)].server
+		if checked[server] {
+			continue
+		}
+		checked[server] = true
+		if !allowed[server] {
+			continue
+		}
+
+		server.Mu.Lock()
+		available := server.Healthy && server.Weight > 0
+		server.Mu.Unlock()
+		if available {
+			return server
+		}
+		if len(checked) == ring.servers {
+			break
+		}
+	}
+	return nil
+}
+
+// hashRing is a consistent hash ring of servers.
+type hashRing struct {
+	// points are sorted by hash.
+	points []ringPoint
+	// servers is the number of servers on the ring.
+	servers int
+}
+
+// ringPoint is a point of a server on a hashRing.
+type ringPoint struct {
+	hash   uint64
+	server *Server
+}
+
+// newHashRing returns the ring of servers with their current weights.
+// Servers with a weight of zero are left out.
+func newHashRing(servers []*Server, weighted bool) *hashRing {
+	ring := &hashRing{}
+	for _, server := range servers {
+		server.Mu.Lock()
+		weight := server.Weight
+		server.Mu.Unlock()
+		if weight <= 0 {
+			continue
+		}
+		ring.servers++
+		replicas := ringReplicas
+		if weighted {
+			replicas *= weight
+		}
+		for j := range replicas {
+			ring.points = append(ring.points, ringPoint{
+				hash:   ringHash(server.URL.String() + "#" + strconv.Itoa(j)),
+				server: server,
+			})
+		}
+	}
+	slices.SortFunc(ring.points, func(a, b ringPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	return ring
+}
+
+// ringHash returns the position of s on the ring.
+//
+// The FNV-1a hash is mixed with the SplitMix64 finalizer as similar
+// strings, such as the points of a server, have close FNV hashes.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// keyShares returns the share of n client IPs b sends to each of servers,
+// and the server of each of them.
+func keyShares(b keyedBalancer, servers []*Server, n int) ([]float64, []*Server) {
+	counts := map[*Server]int{}
+	selected := make([]*Server, n)
+	for i := range n {
+		selected[i] = b.NextKey(servers, fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff))
+		counts[selected[i]]++
+	}
+	result := make([]float64, len(servers))
+	for i, server := range servers {
+		result[i] = float64(counts[server]) / float64(n)
+	}
+	return result, selected
+}
+
+func TestIPHashDistribution(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		weighted bool
+		weights  []int
+		want     []float64
+	}{
+		{"unweighted", false, []int{1, 2, 5}, []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}},
+		{"weighted", true, []int{1, 2, 5}, []float64{1.0 / 8, 2.0 / 8, 5.0 / 8}},
+		// Servers without weight are left out of the ring.
+		{"weightless server", true, []int{1, 0, 3}, []float64{0.25, 0, 0.75}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := testServers(t, tt.weights...)
+			h := newIPHash(tt.weighted)
+			h.OnServersChanged(servers)
+			got, _ := keyShares(h, servers, 20000)
+			// The points of each server leave the shares a few percent off.
+			for i := range tt.want {
+				if math.Abs(got[i]-tt.want[i]) > 0.06 {
+					t.Errorf("server %d with weight %d got %.3f of the keyspace, want %.3f", i, tt.weights[i], got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIPHashMinimalRemap(t *testing.T) {
+	for _, weighted := range []bool{false, true} {
+		t.Run(fmt.Sprint("weighted ", weighted), func(t *testing.T) {
+			servers := testServers(t, 1, 2, 3, 4)
+			h := newIPHash(weighted)
+			h.OnServersChanged(servers)
+			_, before := keyShares(h, servers, 10000)
+
+			// removed is the server taken out of the pool.
+			removed := servers[2]
+			remaining := []*Server{servers[0], servers[1], servers[3]}
+			h.OnServersChanged(remaining)
+			_, after := keyShares(h, remaining, 10000)
+
+			moved := 0
+			for i := range before {
+				switch {
+				case before[i] == removed:
+					moved++
+					if after[i] == removed {
+						t.Fatalf("key %d still sent to the removed server", i)
+					}
+				case after[i] != before[i]:
+					t.Fatalf("key %d moved from %s to %s, want only the keys of the removed server moved", i, before[i].URL, after[i].URL)
+				}
+			}
+			if moved == 0 {
+				t.Error("no key was sent to the removed server")
+			}
+
+			// An unhealthy server only moves its own keys as well.
+			h.OnServersChanged(servers)
+			removed.Healthy = false
+			_, unhealthy := keyShares(h, servers, 10000)
+			for i := range before {
+				if before[i] != removed && unhealthy[i] != before[i] {
+					t.Fatalf("key %d moved from %s to %s with another server unhealthy", i, before[i].URL, unhealthy[i].URL)
+				}
+			}
+		})
+	}
+}
+
+func TestWeightedIPHashProxied(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q, "weight": 1}, {"url": %q, "weight": 3}],
+		"algorithm": "weighted-ip-hash",
+		"disableHealthChecks": true
+	}`, newBackend(t, handler).URL, newBackend(t, handler).URL))
+	st := lb.State()
+
+	// Each client keeps its server.
+	for i := range 1000 {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = fmt.Sprintf("192.0.2.%d:%d", i%100, 1000+i)
+		serve(lb, r)
+	}
+	first, second := st.Servers[0].Requests.Load(), st.Servers[1].Requests.Load()
+	if first%10 != 0 || second%10 != 0 || first+second != 1000 {
+		t.Errorf("servers got %d and %d requests, want the 10 requests of each client on the same server", first, second)
+	}
+	if second < first {
+		t.Errorf("servers with weights 1 and 3 got %d and %d requests, want more for the heavier", first, second)
+	}
+}
+
+func TestIPHashServersChanged(t *testing.T) {
+	backends := map[string]string{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		backends[name] = newBackend(t, func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, name) }).URL
+	}
+	config := `{
+		"servers": [%s],
+		"algorithm": "weighted-ip-hash",
+		"disableHealthChecks": true
+	}`
+	servers := func(names ...string) string {
+		var list []string
+		for _, name := range names {
+			list = append(list, fmt.Sprintf("{%q: %q}", "url", backends[name]))
+		}
+		return strings.Join(list, ", ")
+	}
+	path := writeConfig(t, fmt.Sprintf(config, servers("a", "b", "c")))
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := newState(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := NewLoadBalancer(st)
+	t.Cleanup(func() { lb.State().Stop() })
+	admin := newAdminHandler(&AdminConfig{}, lb)
+
+	// route returns the backend answering each of the clients.
+	route := func() []string {
+		names := make([]string, 200)
+		for i := range names {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i)
+			w := serve(lb, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("request of client %d got %d, want 200", i, w.Code)
+			}
+			names[i] = w.Body.String()
+		}
+		return names
+	}
+	// Traffic keeps flowing while the servers change.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				r := httptest.NewRequest("GET", "/", nil)
+				r.RemoteAddr = fmt.Sprintf("198.51.100.%d:1234", i)
+				if serve(lb, r).Code != http.StatusOK {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+
+	before := route()
+	w := serve(admin, httptest.NewRequest("POST", "/admin/servers/"+url.PathEscape(backends["b"])+"/weight", strings.NewReader(`{"weight": 0}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("setting the weight: %d, want 200", w.Code)
+	}
+	weighted := route()
+	for i := range before {
+		if weighted[i] == "b" || before[i] != "b" && weighted[i] != before[i] {
+			t.Fatalf("client %d moved from %s to %s with the weight of b set to 0", i, before[i], weighted[i])
+		}
+	}
+
+	// The reload removes b, then out of the ring, and adds d.
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(config, servers("a", "c", "d"))), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.Reload(path); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := route()
+	moved := 0
+	for i := range weighted {
+		if reloaded[i] != weighted[i] {
+			moved++
+			if reloaded[i] != "d" {
+				t.Fatalf("client %d moved from %s to %s with d added, want to d", i, weighted[i], reloaded[i])
+			}
+		}
+	}
+	if moved == 0 {
+		t.Error("no client moved to the added server")
+	}
+
+	close(stop)
+	wg.Wait()
+	if n := failed.Load(); n != 0 {
+		t.Errorf("%d requests failed while the servers changed", n)
+	}
+}
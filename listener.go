@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerConfig represents the configuration of a listener.
+type ListenerConfig struct {
+	// Address to listen on, e.g. ":8443".
+	Address string `json:"address"`
+	// TLSCert is the path of the certificate file. TLS is enabled when set.
+	TLSCert string `json:"tlsCert"`
+	// TLSKey is the path of the private key file.
+	TLSKey string `json:"tlsKey"`
+	// H2C accepts HTTP/2 with prior knowledge on plain-text connections,
+	// e.g. for gRPC clients.
+	H2C bool `json:"h2c"`
+}
+
+// listen starts serving srv according to l in a new goroutine.
+// Errors other than http.ErrServerClosed are sent to errs.
+func listen(srv *http.Server, l ListenerConfig, errs chan<- error) {
+	go func() {
+		var err error
+		if l.TLSCert != "" {
+			slog.Info("Starting TLS server", "address", l.Address)
+			err = srv.ListenAndServeTLS(l.TLSCert, l.TLSKey)
+		} else {
+			slog.Info("Starting server", "address", l.Address)
+			err = srv.ListenAndServe()
+		}
+
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errs <- err
+		}
+	}()
+}
+
+// trackedServer is an http.Server counting its open connections.
+type trackedServer struct {
+	*http.Server
+	conns atomic.Int64
+}
+
+// newTrackedServer returns srv tracking its connections.
+func newTrackedServer(srv *http.Server) *trackedServer {
+	ts := &trackedServer{Server: srv}
+	srv.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			ts.conns.Add(1)
+		case http.StateHijacked, http.StateClosed:
+			ts.conns.Add(-1)
+		}
+	}
+	return ts
+}
+
+// shutdown gracefully shuts down all servers concurrently, closing the
+// connections remaining after timeout.
+func shutdown(servers []*trackedServer, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := srv.Shutdown(ctx)
+			if errors.Is(err, context.DeadlineExceeded) {
+				n := srv.conns.Load()
+				err = srv.Close()
+				slog.Warn("Forced connections closed", "address", srv.Addr, "connections", n, "timeout", timeout.String())
+			}
+			if err != nil {
+				slog.Error("Error shutting down server", "address", srv.Addr, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
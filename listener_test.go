@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeAddress returns a local address nothing listens on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// getWhenListening makes GET requests to url until it is listened on.
+func getWhenListening(t *testing.T, url string) (*http.Response, error) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		res, err := http.Get(url)
+		if err == nil || time.Now().After(deadline) {
+			return res, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "backend")
+	})
+	addresses := []string{freeAddress(t), freeAddress(t)}
+	config := fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"listeners": [{"address": %q}, {"address": %q}]
+	}`, backend.URL, addresses[0], addresses[1])
+	c, err := loadConfig(writeConfig(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := newStartupOptions(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.listeners) != 2 {
+		t.Fatalf("%d listeners, want 2", len(opts.listeners))
+	}
+	lb := newTestLoadBalancer(t, config)
+
+	errs := make(chan error, len(opts.listeners))
+	for _, l := range opts.listeners {
+		srv := &http.Server{Addr: l.Address, Handler: lb}
+		listen(srv, l, errs)
+		defer srv.Close()
+	}
+
+	for _, address := range addresses {
+		res, err := getWhenListening(t, "http://"+address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != "backend" {
+			t.Errorf("listener %s answered %d %q, want 200 %q", address, res.StatusCode, body, "backend")
+		}
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("listener error: %v", err)
+	default:
+	}
+}
+
+func TestListenersSameAddress(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `{
+		"servers": ["backend"],
+		"listeners": [{"address": ":8080"}, {"address": ":8080"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newStartupOptions(c); err == nil {
+		t.Error("newStartupOptions accepted two listeners on the same address")
+	}
+}
+
+// newH2CServer returns a server accepting HTTP/2 only with prior
+// knowledge, closed at the end of the test.
+func newH2CServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestH2C(t *testing.T) {
+	// A unary gRPC call, as seen on the wire.
+	backend := newH2CServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"backendH2C": true
+	}`, backend.URL))
+	frontend := newH2CServer(t, lb)
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+	req, err := http.NewRequest("POST", frontend.URL+"/echo.Echo/Say", strings.NewReader("\x00\x00\x00\x00\x02hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+		t.Fatalf("call answered %d over %s, want 200 over HTTP/2", res.StatusCode, res.Proto)
+	}
+	if string(body) != "\x00\x00\x00\x00\x02hi" {
+		t.Errorf("call answered %q, want the message echoed", body)
+	}
+	if got := res.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", got)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	config := fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"maxHeaderBytes": 1024
+	}`, backend.URL)
+	c, err := loadConfig(writeConfig(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontend := httptest.NewUnstartedServer(newTestLoadBalancer(t, config))
+	frontend.Config.MaxHeaderBytes = c.MaxHeaderBytes
+	frontend.Start()
+	t.Cleanup(frontend.Close)
+
+	for _, tt := range []struct {
+		size int
+		want int
+	}{
+		{100, http.StatusOK},
+		// net/http allows a few kilobytes above the limit.
+		{16384, http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		req, err := http.NewRequest("GET", frontend.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Large", strings.Repeat("x", tt.size))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("request with a %d byte header got %d, want %d", tt.size, res.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestMaxHeaderBytesDefault(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		want   int
+	}{
+		{`{"servers": ["backend"]}`, http.DefaultMaxHeaderBytes},
+		{`{"servers": ["backend"], "maxHeaderBytes": 2048}`, 2048},
+	} {
+		c, err := loadConfig(writeConfig(t, tt.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.MaxHeaderBytes != tt.want {
+			t.Errorf("maxHeaderBytes of %s = %d, want %d", tt.config, c.MaxHeaderBytes, tt.want)
+		}
+	}
+
+	c, err := loadConfig(writeConfig(t, `{"servers": ["backend"], "maxHeaderBytes": -1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newStartupOptions(c); err == nil {
+		t.Error("negative maxHeaderBytes accepted")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	logs := captureLogs(t)
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hung" {
+			<-r.Context().Done()
+		}
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true
+	}`, backend.URL))
+	address := freeAddress(t)
+	srv := newTrackedServer(&http.Server{Addr: address, Handler: lb})
+	errs := make(chan error, 1)
+	listen(srv.Server, ListenerConfig{Address: address}, errs)
+
+	res, err := getWhenListening(t, "http://"+address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	failed := make(chan error, 1)
+	go func() {
+		res, err := http.Get("http://" + address + "/hung")
+		if err == nil {
+			res.Body.Close()
+		}
+		failed <- err
+	}()
+	for active(lb.State().Servers[0]) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	shutdown([]*trackedServer{srv}, 100*time.Millisecond)
+	if d := time.Since(start); d < 100*time.Millisecond || d > time.Second {
+		t.Errorf("shutdown with a hung request took %s, want its timeout", d)
+	}
+	if err := <-failed; err == nil {
+		t.Error("hung request succeeded after the shutdown")
+	}
+	for deadline := time.Now().Add(time.Second); srv.conns.Load() != 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := srv.conns.Load(); n != 0 {
+		t.Errorf("%d connections after the shutdown, want 0", n)
+	}
+	if !strings.Contains(logs.String(), `"msg":"Forced connections closed"`) {
+		t.Errorf("forced close not logged:\n%s", logs)
+	}
+}
+
+func TestShutdownGraceful(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true
+	}`, backend.URL))
+	address := freeAddress(t)
+	srv := newTrackedServer(&http.Server{Addr: address, Handler: lb})
+	listen(srv.Server, ListenerConfig{Address: address}, make(chan error, 1))
+	res, err := getWhenListening(t, "http://"+address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	codes := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + address)
+		if err != nil {
+			codes <- 0
+			return
+		}
+		res.Body.Close()
+		codes <- res.StatusCode
+	}()
+	for active(lb.State().Servers[0]) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	shutdown([]*trackedServer{srv}, 5*time.Second)
+	if code := <-codes; code != http.StatusOK {
+		t.Errorf("request in flight during the shutdown got %d, want 200", code)
+	}
+}
+
+func TestDisableKeepAlives(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprint("disabled ", disabled), func(t *testing.T) {
+			config := fmt.Sprintf(`{
+				"servers": [{"url": %q}],
+				"disableHealthChecks": true,
+				"disableKeepAlives": %t
+			}`, backend.URL, disabled)
+			c, err := loadConfig(writeConfig(t, config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			frontend, conns := newCountingBackend(t, newTestLoadBalancer(t, config).ServeHTTP)
+			frontend.Config.SetKeepAlivesEnabled(!c.DisableKeepAlives)
+
+			transport := &http.Transport{}
+			defer transport.CloseIdleConnections()
+			client := &http.Client{Transport: transport}
+			for range 3 {
+				res, err := client.Get(frontend.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+				// Set by the Connection: close header, which the client removes.
+				if res.Close != disabled {
+					t.Errorf("response closing the connection %v, want %v", res.Close, disabled)
+				}
+			}
+			want := int64(1)
+			if disabled {
+				want = 3
+			}
+			if got := conns.Load(); got != want {
+				t.Errorf("%d connections for 3 requests, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,1127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// State represents the running configuration of the load balancer.
+//
+// A State is never modified once in use, so that a configuration
+// reload can replace it atomically.
+type State struct {
+	// Config the state was built from.
+	Config Config
+	// Servers contains the servers of all pools.
+	Servers []*Server
+	// Pools contains the pools by name.
+	Pools map[string]*Pool
+	// Router selects the pool of a request.
+	Router *Router
+	// BackendTimeout is the maximum duration of a proxied request.
+	BackendTimeout time.Duration
+	// Cache of responses, nil when disabled.
+	Cache *ResponseCache
+	// Queue of requests, nil when the number of in-flight requests is
+	// not limited.
+	Queue *requestQueue
+
+	// trustedProxies contains the proxies whose X-Forwarded-For header is
+	// trusted.
+	trustedProxies prefixSet
+	ipFilter       ipFilter
+	// requestLimits is nil when the proxied requests are not restricted.
+	requestLimits *requestLimits
+	// weightDecay is nil when the weights do not decay on errors.
+	weightDecay *weightDecay
+	// accessLog is nil when the access log is disabled.
+	accessLog *accessLog
+	// fallback is nil when there is no fallback response.
+	fallback *staticResponse
+	// maintenance is nil when the maintenance mode is disabled.
+	maintenance *maintenance
+	// notFound is nil when unmatched requests get the default 404.
+	notFound *staticResponse
+	// proxyErrorPage is nil when the proxy errors get the default body.
+	proxyErrorPage *proxyErrorPage
+	// responseRate is nil when the responses may be streamed at any rate.
+	responseRate *responseRate
+	retryPolicy  retryPolicy
+	// healthChecker is nil when health checks are disabled.
+	healthChecker *HealthChecker
+	// readinessCheck is nil when the readiness probe checks no server.
+	readinessCheck *readinessCheck
+	// belowMinHealthy is true while fewer than Config.MinHealthyServers
+	// servers are healthy.
+	belowMinHealthy atomic.Bool
+	stop            chan struct{}
+}
+
+// newState validates config and returns the state it describes.
+func newState(config Config) (*State, error) {
+	if config.MinHealthyServers < 0 {
+		return nil, fmt.Errorf("parsing minHealthyServers: must not be negative")
+	}
+	readinessCheck, err := newReadinessCheck(config.ReadinessCheck)
+	if err != nil {
+		return nil, err
+	}
+	if readinessCheck != nil && config.DisableHealthChecks {
+		return nil, fmt.Errorf("parsing readinessCheck: health checks are disabled")
+	}
+	if config.StartUnhealthy && config.DisableHealthChecks {
+		return nil, fmt.Errorf("parsing startUnhealthy: health checks are disabled")
+	}
+	if config.HealthCheckGracePeriod < 0 {
+		return nil, fmt.Errorf("parsing healthCheckGracePeriod: must not be negative")
+	}
+	var healthChecker *HealthChecker
+	if !config.DisableHealthChecks {
+		healthCheckInterval := time.Duration(config.HealthCheckInterval)
+		if healthCheckInterval <= 0 {
+			return nil, fmt.Errorf("parsing healthCheckInterval: must be greater than 0")
+		}
+		stableInterval := time.Duration(config.HealthCheckStableInterval)
+		if stableInterval < 0 {
+			return nil, fmt.Errorf("parsing healthCheckStableInterval: must not be negative")
+		}
+		if config.HealthCheckStableAfter < 0 {
+			return nil, fmt.Errorf("parsing healthCheckStableAfter: must not be negative")
+		}
+		if config.CertExpiryWarningDays < 0 {
+			return nil, fmt.Errorf("parsing certExpiryWarningDays: must not be negative")
+		}
+		switch config.HealthCheckSchedule {
+		case scheduleSimultaneous, scheduleStaggered, scheduleJitter:
+		default:
+			return nil, fmt.Errorf("parsing healthCheckSchedule: unknown schedule %q", config.HealthCheckSchedule)
+		}
+		method := strings.ToUpper(config.HealthCheckMethod)
+		if method == "" || strings.ContainsAny(method, " \t\r\n") {
+			return nil, fmt.Errorf("parsing healthCheckMethod: invalid method %q", config.HealthCheckMethod)
+		}
+		if method == http.MethodHead && (config.HealthyBodyContains != "" || config.HealthLoadField != "") {
+			return nil, fmt.Errorf("parsing healthCheckMethod: HEAD responses have no body for healthyBodyContains or healthLoadField")
+		}
+		var dialer *net.Dialer
+		var transport http.RoundTripper
+		if config.HealthCheckSourceAddress != "" {
+			if config.HealthCheckUseProxyTransport {
+				return nil, fmt.Errorf("parsing healthCheckSourceAddress: cannot be combined with healthCheckUseProxyTransport")
+			}
+			ip := net.ParseIP(config.HealthCheckSourceAddress)
+			if ip == nil {
+				return nil, fmt.Errorf("parsing healthCheckSourceAddress: invalid IP %q", config.HealthCheckSourceAddress)
+			}
+			dialer = &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}, Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.DialContext = dialer.DialContext
+			transport = t
+		}
+		switch config.HealthCheckRedirects {
+		case redirectsFollow, redirectsSameHost, redirectsNone:
+		default:
+			return nil, fmt.Errorf("parsing healthCheckRedirects: unknown policy %q", config.HealthCheckRedirects)
+		}
+		if config.HealthCheckMaxLatency < 0 {
+			return nil, fmt.Errorf("parsing healthCheckMaxLatency: must not be negative")
+		}
+		switch config.HealthCheckSlowAction {
+		case slowDegrade, slowUnhealthy:
+		default:
+			return nil, fmt.Errorf("parsing healthCheckSlowAction: unknown action %q", config.HealthCheckSlowAction)
+		}
+		healthChecker = &HealthChecker{
+			Interval:           healthCheckInterval,
+			StableInterval:     stableInterval,
+			StableAfter:        config.HealthCheckStableAfter,
+			Schedule:           config.HealthCheckSchedule,
+			BodyContains:       config.HealthyBodyContains,
+			LoadHeader:         config.HealthLoadHeader,
+			LoadField:          config.HealthLoadField,
+			CertExpiryWarning:  time.Duration(config.CertExpiryWarningDays) * 24 * time.Hour,
+			UseServerTransport: config.HealthCheckUseProxyTransport,
+			Redirects:          config.HealthCheckRedirects,
+			Method:             method,
+			UserAgent:          config.HealthCheckUserAgent,
+			Dialer:             dialer,
+			Transport:          transport,
+			MaxLatency:         time.Duration(config.HealthCheckMaxLatency),
+			SlowAction:         config.HealthCheckSlowAction,
+		}
+	}
+
+	backendTimeout := time.Duration(config.BackendTimeout)
+	balancerOpts := BalancerOptions{
+		FailoverHoldDown:        time.Duration(config.FailoverHoldDown),
+		ConnectionsLatencyAlpha: 0.5,
+	}
+	if alpha := config.ConnectionsLatencyAlpha; alpha != nil {
+		if !(*alpha >= 0 && *alpha <= 1) {
+			return nil, fmt.Errorf("parsing connectionsLatencyAlpha: must be between 0 and 1")
+		}
+		balancerOpts.ConnectionsLatencyAlpha = *alpha
+	}
+
+	// Pools fall back to the global algorithm, validated even if every
+	// pool overrides it.
+	if _, err := newBalancer(config.Algorithm, balancerOpts); err != nil {
+		return nil, fmt.Errorf("parsing algorithm: %w", err)
+	}
+
+	if config.MaxRetries < 0 {
+		return nil, fmt.Errorf("parsing maxRetries: must not be negative")
+	}
+	if config.StreamingThresholdBytes < 0 {
+		return nil, fmt.Errorf("parsing streamingThresholdBytes: must not be negative")
+	}
+	if config.MaxRetryBodyBytes < 0 {
+		return nil, fmt.Errorf("parsing maxRetryBodyBytes: must not be negative")
+	}
+	if config.MaxBufferBytes < 0 {
+		return nil, fmt.Errorf("parsing maxBufferBytes: must not be negative")
+	}
+	if err := validateRewrites(config.ResponseRewrites); err != nil {
+		return nil, err
+	}
+	if err := validateStatusRewrites(config.StatusRewrites); err != nil {
+		return nil, err
+	}
+
+	retryPolicy, err := newRetryPolicy(config.RetryMethods, config.RetryIdempotencyKey, config.RetryOnStatus)
+	if err != nil {
+		return nil, err
+	}
+	retryPolicy.backoff = time.Duration(config.RetryBackoff)
+
+	if config.StickyFailureMode != stickyFailover && config.StickyFailureMode != stickyError {
+		return nil, fmt.Errorf("parsing stickyFailureMode: unknown mode %q", config.StickyFailureMode)
+	}
+
+	if config.ExpectContinueTimeout < 0 {
+		return nil, fmt.Errorf("parsing expectContinueTimeout: must not be negative")
+	}
+	if strings.ContainsAny(config.RequestIDHeader, " \t\r\n:") {
+		return nil, fmt.Errorf("parsing requestIDHeader: invalid header name %q", config.RequestIDHeader)
+	}
+	if config.MaxConnsPerHost < 0 {
+		return nil, fmt.Errorf("parsing maxConnsPerHost: must not be negative")
+	}
+	if config.MaxConnLifetime < 0 {
+		return nil, fmt.Errorf("parsing maxConnLifetime: must not be negative")
+	}
+	transport := newTransport(config)
+
+	poolConfigs := maps.Clone(config.Pools)
+	if poolConfigs == nil {
+		poolConfigs = map[string]PoolConfig{}
+	}
+	if len(config.Servers) > 0 || len(config.Pools) == 0 {
+		if _, ok := poolConfigs[defaultPoolName]; ok {
+			return nil, fmt.Errorf("parsing pools: pool %q conflicts with the top-level servers", defaultPoolName)
+		}
+		poolConfigs[defaultPoolName] = PoolConfig{Servers: config.Servers}
+	}
+
+	// The default pool comes first, followed by the others sorted by name.
+	poolNames := slices.Sorted(maps.Keys(poolConfigs))
+	if i := slices.Index(poolNames, defaultPoolName); i > 0 {
+		poolNames = slices.Insert(slices.Delete(poolNames, i, i+1), 0, defaultPoolName)
+	}
+
+	// Servers listed in several pools are shared by them.
+	var servers []*Server
+	serversByURL := map[string]*Server{}
+	pools := map[string]*Pool{}
+	for _, name := range poolNames {
+		pc := poolConfigs[name]
+		pool := &Pool{Name: name, PreserveHost: config.PreserveHost}
+		if pc.PreserveHost != nil {
+			pool.PreserveHost = *pc.PreserveHost
+		}
+		algorithm := config.Algorithm
+		if pc.Algorithm != "" {
+			algorithm = pc.Algorithm
+		}
+		pool.Algorithm = algorithm
+		if pool.StripPrefix, err = parsePathPrefix(pc.StripPrefix); err != nil {
+			return nil, fmt.Errorf("parsing pools: pool %q: stripPrefix: %w", name, err)
+		}
+		if pool.AddPrefix, err = parsePathPrefix(pc.AddPrefix); err != nil {
+			return nil, fmt.Errorf("parsing pools: pool %q: addPrefix: %w", name, err)
+		}
+		pool.Balancer, err = newBalancer(algorithm, balancerOpts)
+		if err != nil {
+			return nil, fmt.Errorf("parsing pools: pool %q: %w", name, err)
+		}
+		listed := map[string]bool{}
+		for _, serverConfig := range pc.Servers {
+			u, err := normalizeServerURL(serverConfig.URL)
+			if err != nil {
+				return nil, err
+			}
+			serverConfig.URL = u.String()
+			if listed[serverConfig.URL] {
+				return nil, fmt.Errorf("parsing pools: server %s is listed twice in pool %q", redactUserinfo(u), name)
+			}
+			listed[serverConfig.URL] = true
+			server, ok := serversByURL[serverConfig.URL]
+			if !ok {
+				server, err = newServer(serverConfig, transport)
+				if err != nil {
+					return nil, err
+				}
+				serversByURL[serverConfig.URL] = server
+				servers = append(servers, server)
+			}
+			pool.Servers = append(pool.Servers, server)
+		}
+		if len(pool.Servers) == 0 {
+			slog.Warn("Pool has no servers, its requests are answered with 503", "pool", name)
+		}
+		pool.serversChanged()
+		pools[name] = pool
+	}
+	if config.StartUnhealthy {
+		for _, server := range servers {
+			server.Healthy = false
+		}
+	}
+	if config.HealthCheckGracePeriod > 0 {
+		graceUntil := time.Now().Add(time.Duration(config.HealthCheckGracePeriod))
+		for _, server := range servers {
+			server.GraceUntil = graceUntil
+		}
+	}
+
+	router, err := newRouter(config.Routes, pools, config.DefaultPool)
+	if err != nil {
+		return nil, err
+	}
+
+	var cache *ResponseCache
+	if config.Cache != nil {
+		defaultTTL := time.Duration(config.Cache.DefaultTTL)
+		if defaultTTL < 0 {
+			return nil, fmt.Errorf("parsing cache.defaultTTL: must not be negative")
+		}
+		if config.Cache.Size <= 0 {
+			return nil, fmt.Errorf("parsing cache.size: must be greater than 0")
+		}
+		cache = NewResponseCache(config.Cache.Size, defaultTTL)
+	}
+
+	var queue *requestQueue
+	if config.Queue != nil {
+		queue, err = newRequestQueue(config.Queue)
+		if err != nil {
+			return nil, fmt.Errorf("parsing queue: %w", err)
+		}
+	}
+
+	trustedProxies, err := parsePrefixes(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("parsing trustedProxies: %w", err)
+	}
+	ipFilter, err := newIPFilter(config.AllowCIDRs, config.DenyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	requestLimits, err := newRequestLimits(config)
+	if err != nil {
+		return nil, err
+	}
+	weightDecay, err := newWeightDecay(config.ErrorWeightDecay)
+	if err != nil {
+		return nil, err
+	}
+	accessLog, err := newAccessLog(config)
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := newFallback(config.Fallback)
+	if err != nil {
+		return nil, err
+	}
+	maintenance, err := newMaintenance(config.Maintenance)
+	if err != nil {
+		return nil, err
+	}
+	notFound, err := newNotFound(config.NotFound)
+	if err != nil {
+		return nil, err
+	}
+	responseRate, err := newResponseRate(config.MinResponseRate)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &State{
+		Config:         config,
+		Servers:        servers,
+		Pools:          pools,
+		Router:         router,
+		BackendTimeout: backendTimeout,
+		Cache:          cache,
+		Queue:          queue,
+		trustedProxies: trustedProxies,
+		ipFilter:       ipFilter,
+		requestLimits:  requestLimits,
+		weightDecay:    weightDecay,
+		accessLog:      accessLog,
+		fallback:       fallback,
+		maintenance:    maintenance,
+		notFound:       notFound,
+		proxyErrorPage: newProxyErrorPage(config.ProxyError),
+		responseRate:   responseRate,
+		retryPolicy:    retryPolicy,
+		healthChecker:  healthChecker,
+		readinessCheck: readinessCheck,
+		stop:           make(chan struct{}),
+	}
+	if healthChecker != nil && config.MinHealthyServers > 0 {
+		healthChecker.OnChange = st.checkMinHealthy
+	}
+	return st, nil
+}
+
+// newServer returns the server described by config.
+func newServer(config ServerConfig, transport http.RoundTripper) (*Server, error) {
+	u, err := normalizeServerURL(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if config.Weight < 0 {
+		return nil, fmt.Errorf("parsing servers: weight of %s must not be negative", redactUserinfo(u))
+	}
+	healthCheckURL := u
+	if config.HealthCheckURL != "" {
+		healthCheckURL, err = normalizeServerURL(config.HealthCheckURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	checks, err := newHealthChecks(healthCheckURL, config.Checks)
+	if err != nil {
+		return nil, err
+	}
+	var queue *requestQueue
+	if config.Queue != nil {
+		queue, err = newRequestQueue(config.Queue)
+		if err != nil {
+			return nil, fmt.Errorf("parsing servers: queue of %s: %w", redactUserinfo(u), err)
+		}
+	}
+	for name := range config.Labels {
+		if !metricLabelName.MatchString(name) || reservedLabelNames[name] || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("parsing servers: label %q of %s: invalid name", name, redactUserinfo(u))
+		}
+	}
+
+	return &Server{
+		config:         config,
+		URL:            u,
+		ID:             serverID(u.String()),
+		Mu:             &sync.Mutex{},
+		checkMu:        make(chan struct{}, 1),
+		Healthy:        true,
+		Weight:         config.Weight,
+		WeightFactor:   1,
+		Priority:       config.Priority,
+		HealthCheckURL: healthCheckURL,
+		Checks:         checks,
+		Queue:          queue,
+		Labels:         config.Labels,
+		Transport:      transport,
+	}, nil
+}
+
+// normalizeServerURL parses the URL of a server, defaulting to the http
+// scheme, e.g. "host:9000" becomes "http://host:9000". The default port
+// of the scheme is removed, "https://host:443" becomes "https://host", so
+// that it is not sent in the Host header. Its path is cleaned,
+// "http://host//app/" becomes "http://host/app".
+func normalizeServerURL(rawURL string) (*url.URL, error) {
+	absURL := rawURL
+	if !strings.Contains(rawURL, "://") {
+		absURL = "http://" + rawURL
+	}
+	u, err := url.Parse(absURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing servers (server URLs): %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("parsing servers: %q has unsupported scheme %q", rawURL, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("parsing servers: %q has no host", rawURL)
+	}
+	u.Host = stripDefaultPort(u.Scheme, u.Host)
+	// The path prefixes the proxied paths, without duplicate or trailing
+	// slashes.
+	if p := u.EscapedPath(); p != "" {
+		p = strings.TrimSuffix(path.Clean("/"+p), "/")
+		// The path was escaped by u.
+		u.Path, _ = url.PathUnescape(p)
+		u.RawPath = p
+	}
+	return u, nil
+}
+
+// stripDefaultPort returns host without the port if it is the default
+// port of scheme, e.g. "host:80" becomes "host" for http.
+func stripDefaultPort(scheme, host string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		// IPv6 addresses keep their brackets.
+		if strings.Contains(h, ":") {
+			return "[" + h + "]"
+		}
+		return h
+	}
+	return host
+}
+
+// checkMinHealthy logs when the number of healthy servers crosses
+// Config.MinHealthyServers.
+func (st *State) checkMinHealthy() {
+	healthy := countHealthy(st.Servers)
+	below := healthy < st.Config.MinHealthyServers
+	if st.belowMinHealthy.Swap(below) == below {
+		return
+	}
+	if below {
+		slog.Error("Fewer healthy servers than minHealthyServers", "healthy", healthy, "minHealthyServers", st.Config.MinHealthyServers)
+	} else {
+		slog.Info("Enough healthy servers again", "healthy", healthy, "minHealthyServers", st.Config.MinHealthyServers)
+	}
+}
+
+// Start starts goroutines that periodically checks each server health
+// by making an HTTP GET request to it.
+func (st *State) Start() {
+	if st.healthChecker == nil {
+		return
+	}
+	if st.Config.MinHealthyServers > 0 {
+		st.checkMinHealthy()
+	}
+	for i, server := range st.Servers {
+		go st.healthChecker.Run(server, st.healthChecker.Offset(i, len(st.Servers)), st.stop)
+	}
+}
+
+// Stop stops the health checks started by Start.
+func (st *State) Stop() {
+	close(st.stop)
+}
+
+// LoadBalancer is the HTTP handler that selects a server using the
+// configured algorithm and proxies the request to it.
+type LoadBalancer struct {
+	// Metrics of the requests handled by the load balancer.
+	Metrics *Metrics
+
+	state    atomic.Pointer[State]
+	draining atomic.Bool
+	rejected atomic.Bool
+	inFlight atomic.Int64
+}
+
+// NewLoadBalancer returns a LoadBalancer running st.
+func NewLoadBalancer(st *State) *LoadBalancer {
+	lb := &LoadBalancer{Metrics: NewMetrics()}
+	lb.observeHealthChecks(st)
+	lb.state.Store(st)
+	st.Start()
+	return lb
+}
+
+// observeHealthChecks records the health checks of st in the metrics.
+func (lb *LoadBalancer) observeHealthChecks(st *State) {
+	if st.healthChecker != nil {
+		st.healthChecker.Observe = lb.Metrics.ObserveHealthCheck
+	}
+}
+
+// Drain marks the load balancer as shutting down, failing its readiness
+// probe while it keeps serving requests.
+func (lb *LoadBalancer) Drain() {
+	lb.draining.Store(true)
+}
+
+// Draining reports whether the load balancer is shutting down.
+func (lb *LoadBalancer) Draining() bool {
+	return lb.draining.Load()
+}
+
+// SetRejected sets whether new requests are answered with 503 instead of
+// being proxied, letting the requests in flight complete. Readiness fails
+// while they are.
+func (lb *LoadBalancer) SetRejected(rejected bool) {
+	lb.rejected.Store(rejected)
+}
+
+// Rejected reports whether new requests are answered with 503.
+func (lb *LoadBalancer) Rejected() bool {
+	return lb.rejected.Load()
+}
+
+// InFlight returns the number of requests being handled.
+func (lb *LoadBalancer) InFlight() int64 {
+	return lb.inFlight.Load()
+}
+
+// NotFound answers r, matching nothing, with the configured response or
+// a 404.
+func (lb *LoadBalancer) NotFound(w http.ResponseWriter, r *http.Request) {
+	if nf := lb.State().notFound; nf != nil {
+		nf.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// State returns the current state.
+func (lb *LoadBalancer) State() *State {
+	return lb.state.Load()
+}
+
+// Reload loads the configuration at path and replaces the current
+// state with it.
+//
+// The current state is kept if the configuration is missing or invalid.
+// Listener and admin settings only take effect on restart.
+func (lb *LoadBalancer) Reload(path string) error {
+	if path == "-" {
+		return fmt.Errorf("configuration read from stdin cannot be reloaded")
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	st, err := newState(config)
+	if err != nil {
+		return err
+	}
+
+	old := lb.state.Load()
+	if old.Cache != nil && reflect.DeepEqual(old.Config.Cache, config.Cache) {
+		st.Cache = old.Cache
+	}
+
+	old.Stop()
+	st.inherit(old)
+	lb.observeHealthChecks(st)
+	lb.state.Store(st)
+	st.Start()
+	return nil
+}
+
+// inherit takes over the servers of old with the same URL and
+// configuration, so that the requests in flight remain counted in their
+// active connections and queues, and that a reload does not send requests
+// to unhealthy servers until they are checked again. The state of the
+// other servers of old with the same URL is copied.
+func (st *State) inherit(old *State) {
+	previous := map[string]*Server{}
+	for _, server := range old.Servers {
+		previous[server.URL.String()] = server
+	}
+	sameTransport := sameTransportConfig(old.Config, st.Config)
+	healthChecked := st.healthChecker != nil && old.healthChecker != nil
+
+	kept := map[*Server]*Server{}
+	for i, server := range st.Servers {
+		p, ok := previous[server.URL.String()]
+		if !ok {
+			continue
+		}
+		// The weight is set in place, weights set by the admin API do not
+		// survive reloads.
+		previousConfig := p.config
+		previousConfig.Weight = server.config.Weight
+		if sameTransport && reflect.DeepEqual(previousConfig, server.config) {
+			p.Mu.Lock()
+			p.config = server.config
+			p.Weight = server.Weight
+			p.Mu.Unlock()
+			if !healthChecked {
+				p.resetHealth(server)
+			}
+			st.Servers[i] = p
+			kept[server] = p
+			continue
+		}
+
+		server.Requests.Store(p.Requests.Load())
+		server.RequestBytes.Store(p.RequestBytes.Load())
+		server.ResponseBytes.Store(p.ResponseBytes.Load())
+		p.Mu.Lock()
+		server.WeightFactor = p.WeightFactor
+		server.Drain = p.Drain
+		p.Mu.Unlock()
+		// Servers are healthy until checked when health checks are disabled.
+		if !healthChecked {
+			continue
+		}
+
+		p.lockChecks(context.Background())
+		server.checkStreak = p.checkStreak
+		p.unlockChecks()
+		p.Mu.Lock()
+		server.Healthy = p.Healthy
+		server.HealthySince = p.HealthySince
+		server.GraceUntil = p.GraceUntil
+		server.LastCheck = p.LastCheck
+		p.Mu.Unlock()
+	}
+	if len(kept) == 0 {
+		return
+	}
+
+	for _, pool := range st.Pools {
+		for i, server := range pool.Servers {
+			if p, ok := kept[server]; ok {
+				pool.Servers[i] = p
+			}
+		}
+		pool.serversChanged()
+	}
+}
+
+// resetHealth resets the health of s to the one of server, a new server
+// with the same URL, when health checks are enabled or disabled.
+func (s *Server) resetHealth(server *Server) {
+	s.lockChecks(context.Background())
+	s.checkStreak = 0
+	s.unlockChecks()
+	s.Mu.Lock()
+	s.Healthy = server.Healthy
+	s.HealthySince = server.HealthySince
+	s.GraceUntil = server.GraceUntil
+	s.LastCheck = server.LastCheck
+	s.NextCheck = server.NextCheck
+	s.Mu.Unlock()
+}
+
+// ServeHTTP proxies r to the server selected by the balancer.
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := lb.state.Load()
+
+	lb.inFlight.Add(1)
+	defer lb.inFlight.Add(-1)
+
+	start := time.Now()
+	sw := &statusResponseWriter{ResponseWriter: w}
+	w = sw
+	routeName := unmatchedRoute
+	var id string
+	if st.Config.RequestIDHeader != "" {
+		id = requestID(w, r, st.Config.RequestIDHeader)
+	}
+	defer func() {
+		d := time.Since(start)
+		lb.Metrics.ObserveRequest(routeName, sw.status, d)
+		if st.accessLog != nil {
+			client, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if ip, ok := clientIP(r, st.trustedProxies); ok {
+				client = ip.String()
+			}
+			st.accessLog.Log(r, client, routeName, id, sw.status, d)
+		}
+	}()
+
+	if v := st.Config.ServerHeader; v != nil && *v != "" {
+		w.Header().Set("Server", *v)
+	}
+
+	if lb.Rejected() {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if st.ipFilter.Enabled() && !st.ipFilter.Allows(clientIP(r, st.trustedProxies)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if st.requestLimits != nil && !st.requestLimits.check(w, r) {
+		return
+	}
+
+	route := st.Router.Match(r)
+	if route == nil {
+		lb.NotFound(w, r)
+		return
+	}
+	routeName = route.Name
+
+	if st.maintenance != nil {
+		ip, ok := clientIP(r, st.trustedProxies)
+		if !ok || !st.maintenance.allow.Contains(ip) {
+			st.maintenance.page.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	// Serve cached responses without contacting a backend.
+	var rec *cacheRecorder
+	var shared *cacheEntry
+	if st.Cache != nil && isCacheableRequest(r) {
+		key := cacheKey(r)
+		if entry, ok := st.Cache.Get(key); ok {
+			entry.write(w)
+			return
+		}
+
+		// Wait for an identical request already proxied, or let the
+		// identical requests wait for this one.
+		flight, leader := st.Cache.Join(key)
+		if leader {
+			defer func() { st.Cache.Finish(key, flight, shared) }()
+		} else {
+			select {
+			case <-flight.done:
+			case <-r.Context().Done():
+				return
+			}
+			if flight.entry != nil {
+				flight.entry.write(w)
+				return
+			}
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rec = newCacheRecorder(w, st.maxBufferBytes(maxCacheEntryBytes))
+		w = rec
+	}
+
+	if st.Queue != nil {
+		wait, err := st.Queue.Acquire(r.Context())
+		lb.Metrics.QueueWait.Observe("", wait.Seconds())
+		if err != nil {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer st.Queue.Release()
+	}
+
+	timeout := st.BackendTimeout
+	if st.Config.MaxRequestTimeout > 0 {
+		if d, ok := requestTimeout(r, time.Duration(st.Config.MaxRequestTimeout)); ok {
+			timeout = d
+		}
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	attempts := 1
+	var body []byte
+	buffered := false
+	if st.retryPolicy.allows(r) {
+		attempts += st.Config.MaxRetries
+		// Requests whose body cannot be buffered are not retried.
+		if attempts > 1 && hasBody(r) {
+			var err error
+			body, buffered, err = bufferBody(r, st.Config.MaxRetryBodyBytes)
+			if err != nil {
+				http.Error(w, "Error reading request body", http.StatusBadRequest)
+				return
+			}
+			if !buffered {
+				attempts = 1
+			}
+		}
+	}
+
+	// The key of the balancers selecting by client IP.
+	var key string
+	if _, ok := route.Pool.Balancer.(keyedBalancer); ok {
+		if ip, ok := clientIP(r, st.trustedProxies); ok {
+			key = ip.String()
+		}
+	}
+
+	var tried []*Server
+	for attempt := range attempts {
+		var server *Server
+		if st.Config.StickySessions && attempt == 0 {
+			var err error
+			server, err = st.nextServerSticky(w, r, route.Pool, key)
+			if err != nil {
+				http.Error(w, "Pinned server is unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		} else {
+			server = st.nextServer(route.Pool, tried, key)
+		}
+		if server == nil {
+			if len(route.Pool.Servers) == 0 {
+				slog.Warn("Request to a pool without servers", "pool", route.Pool.Name)
+			}
+			switch {
+			case st.fallback != nil:
+				st.fallback.ServeHTTP(w, r)
+			case len(route.Pool.Servers) == 0:
+				http.Error(w, "No servers available", http.StatusServiceUnavailable)
+			default:
+				http.Error(w, "No healthy servers available", http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		req := r
+		if buffered {
+			req = r.WithContext(r.Context())
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+
+		err := st.forward(w, req, route.Pool, server, attempt < attempts-1)
+		if err == nil {
+			break
+		}
+		tried = append(tried, server)
+		if err := st.retryPolicy.wait(r.Context(), err); err != nil {
+			st.writeProxyError(w, r, err)
+			break
+		}
+	}
+
+	// The responses of the requests canceled by their client are neither
+	// cached nor shared, the waiting requests being proxied themselves.
+	if rec != nil && !errors.Is(r.Context().Err(), context.Canceled) {
+		shared = st.Cache.Store(cacheKey(r), rec)
+		// Errors are shared with the waiting requests but not cached.
+		if shared == nil && rec.status >= 500 && !rec.overflow && rec.header.Get("Set-Cookie") == "" {
+			shared = &cacheEntry{status: rec.status, header: rec.header, body: rec.body.Bytes()}
+		}
+	}
+}
+
+// modifyResponse modifies the response of a server to r before it is
+// sent to the client.
+func (st *State) modifyResponse(r *http.Request, res *http.Response) error {
+	// The configured header is set by ServeHTTP.
+	if st.Config.ServerHeader != nil {
+		res.Header.Del("Server")
+	}
+	if st.Config.RewriteLocation {
+		rewriteLocation(r, res, st.Config.RewriteLocationHosts)
+	}
+	if err := rewriteStatus(res, st.Config.StatusRewrites); err != nil {
+		return err
+	}
+	return rewriteBody(res, st.Config.ResponseRewrites, st.Config.DecodeGzip, st.maxBufferBytes(maxRewriteBodyBytes))
+}
+
+// maxBufferBytes returns the maximum size of the response bodies buffered
+// in memory, byDefault unless Config.MaxBufferBytes is set.
+func (st *State) maxBufferBytes(byDefault int64) int64 {
+	if st.Config.MaxBufferBytes > 0 {
+		return st.Config.MaxBufferBytes
+	}
+	return byDefault
+}
+
+// flushInterval returns the flush interval of the proxy for res.
+//
+// Streamed responses, of unknown length, and large responses are flushed
+// to the client after each write, while small responses are buffered.
+func (st *State) flushInterval(res *http.Response) time.Duration {
+	if res.ContentLength < 0 || res.ContentLength > st.Config.StreamingThresholdBytes {
+		return -1
+	}
+	return 0
+}
+
+// nextServer returns the next server of pool for key, avoiding the
+// servers already tried, then the degraded servers, when possible.
+//
+// Draining servers are skipped in proportion to the share of their traffic
+// already drained, unless no other server is available.
+func (st *State) nextServer(pool *Pool, tried []*Server, key string) *Server {
+	servers := skipDrained(pool.Servers)
+	if len(tried) > 0 {
+		untried := slices.DeleteFunc(slices.Clone(servers), func(s *Server) bool {
+			return slices.Contains(tried, s)
+		})
+		if server := nextServerNotDraining(pool.Balancer, untried, key); server != nil {
+			return server
+		}
+	}
+	return nextServerNotDraining(pool.Balancer, servers, key)
+}
+
+// nextServerNotDraining returns the next of servers for key according to
+// b, skipping the draining servers when possible.
+func nextServerNotDraining(b Balancer, servers []*Server, key string) *Server {
+	if kept := skipDraining(servers); len(kept) < len(servers) {
+		if server := nextServerPreferFast(b, kept, key); server != nil {
+			return server
+		}
+	}
+	return nextServerPreferFast(b, servers, key)
+}
+
+// nextServerPreferFast returns the next of servers for key according to
+// b, avoiding the degraded servers when possible.
+func nextServerPreferFast(b Balancer, servers []*Server, key string) *Server {
+	fast := slices.DeleteFunc(slices.Clone(servers), func(s *Server) bool {
+		s.Mu.Lock()
+		defer s.Mu.Unlock()
+		return s.LastCheck.Degraded
+	})
+	if len(fast) < len(servers) {
+		if server := nextServerByKey(b, fast, key); server != nil {
+			return server
+		}
+	}
+	return nextServerByKey(b, servers, key)
+}
+
+// forward proxies r to server.
+//
+// If retry is true and the request fails before anything is written
+// to w, nothing is written and forward returns the error so that the
+// request can be retried.
+func (st *State) forward(w http.ResponseWriter, r *http.Request, pool *Pool, server *Server, retry bool) error {
+	if server.Queue != nil {
+		if _, err := server.Queue.Acquire(r.Context()); err != nil {
+			if retry && isRetryableError(err) {
+				return err
+			}
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return nil
+		}
+		defer server.Queue.Release()
+	}
+
+	server.Requests.Add(1)
+	server.Mu.Lock()
+	server.ActiveConnections++
+	server.Mu.Unlock()
+
+	// The connection is released even if the proxy aborts the response.
+	defer func() {
+		server.Mu.Lock()
+		server.ActiveConnections--
+		server.Mu.Unlock()
+	}()
+
+	// Count the bytes exchanged with the server.
+	if r.Body != nil && r.Body != http.NoBody {
+		r = r.WithContext(r.Context())
+		r.Body = countingReader{ReadCloser: r.Body, n: &server.RequestBytes}
+	}
+
+	// Canceled by the response rate watchdog.
+	var cancel context.CancelCauseFunc
+	if st.responseRate != nil {
+		var ctx context.Context
+		ctx, cancel = context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		r = r.WithContext(ctx)
+	}
+
+	// The headers already set, e.g. the request ID or the affinity cookie,
+	// are restored once the response is received, the proxy clearing them
+	// after relaying a 1xx response.
+	header := w.Header().Clone()
+
+	var retryErr error
+	failed := false
+	proxy := server.Proxy(pool)
+	proxy.ModifyResponse = func(res *http.Response) error {
+		maps.Copy(w.Header(), header)
+		failed = res.StatusCode >= 500
+		// The body is closed by the proxy without being read.
+		if retry && st.retryPolicy.statuses[res.StatusCode] {
+			return statusError{status: res.StatusCode}
+		}
+		if err := st.modifyResponse(r, res); err != nil {
+			return err
+		}
+		mergeHeader(header, res)
+		if st.Config.StickySessions {
+			// The affinity cookie is only set by the load balancer, also
+			// for the clients already pinned.
+			removeCookies(res.Header, map[string]bool{stickyCookieName: true})
+		}
+		if st.responseRate != nil {
+			res.Body = st.responseRate.watch(res.Body, func(err error) {
+				slog.Warn("Aborting slow response", "server", server.RedactedURL(), "error", err)
+				cancel(err)
+			})
+		}
+		// The body is copied once ModifyResponse returns.
+		proxy.FlushInterval = st.flushInterval(res)
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		// Retried statuses are answers of the server, not errors of the
+		// proxy, and the last attempt sends them to the client as is.
+		var statusErr statusError
+		if errors.As(err, &statusErr) {
+			slog.Warn("Retrying status", "server", server.RedactedURL(), "status", statusErr.status)
+			retryErr = err
+			return
+		}
+		switch {
+		case isInvalidResponseError(err):
+			slog.Error("Invalid response from server", "server", server.RedactedURL(), "error", err)
+			failed = true
+		case r.Context().Err() == nil || errors.Is(err, context.DeadlineExceeded):
+			slog.Error("Error proxying", "server", server.RedactedURL(), "error", err)
+			// Requests canceled by the clients are not errors of the server.
+			failed = true
+		}
+		if retry && isRetryableError(err) {
+			retryErr = err
+			return
+		}
+		st.writeProxyError(w, req, err)
+	}
+	proxy.ServeHTTP(countingResponseWriter{ResponseWriter: w, n: &server.ResponseBytes}, r)
+	if st.weightDecay != nil {
+		st.weightDecay.Observe(server, failed)
+	}
+
+	return retryErr
+}
+
+// handleReloads reloads the configuration at path on SIGHUP.
+func handleReloads(lb *LoadBalancer, path string, hup <-chan os.Signal) {
+	for range hup {
+		if err := lb.Reload(path); err != nil {
+			slog.Error("Error reloading configuration, keeping the previous one", "error", err)
+			continue
+		}
+		slog.Info("Configuration reloaded")
+	}
+}
@@ -0,0 +1,747 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNormalizeServerURL(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"host", "http://host"},
+		{"host:9000", "http://host:9000"},
+		{"host:80", "http://host"},
+		{"http://host:80", "http://host"},
+		{"http://host:443", "http://host:443"},
+		{"https://host", "https://host"},
+		{"https://host:443", "https://host"},
+		{"https://host:80", "https://host:80"},
+		{"https://host:8443", "https://host:8443"},
+		{"http://[::1]:80", "http://[::1]"},
+		{"http://[::1]:8080", "http://[::1]:8080"},
+		{"10.0.0.1:80", "http://10.0.0.1"},
+		{"http://host//app/", "http://host/app"},
+		{"host/app", "http://host/app"},
+		{"host/app//v1/", "http://host/app/v1"},
+		{"host/", "http://host"},
+		{"host/a%2Fb/", "http://host/a%2Fb"},
+		{"host/app?x=1", "http://host/app?x=1"},
+	} {
+		u, err := normalizeServerURL(tt.in)
+		if err != nil {
+			t.Errorf("normalizeServerURL(%q): %v", tt.in, err)
+			continue
+		}
+		if got := u.String(); got != tt.want {
+			t.Errorf("normalizeServerURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"ftp://host", "http://", "http://:80", "http://host:port"} {
+		if u, err := normalizeServerURL(in); err == nil {
+			t.Errorf("normalizeServerURL(%q) = %q, want an error", in, u)
+		}
+	}
+}
+
+func TestProxyHostWithoutDefaultPort(t *testing.T) {
+	for _, tt := range []struct {
+		url, want string
+	}{
+		{"http://backend", "backend"},
+		{"http://backend:80", "backend"},
+		{"https://backend:443", "backend"},
+		{"http://backend:8080", "backend:8080"},
+	} {
+		server, err := newServer(ServerConfig{URL: tt.url, Weight: 1}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "http://lb.example/x", nil)
+		server.Proxy(&Pool{}).Director(req)
+		if req.Host != tt.want {
+			t.Errorf("Host proxied to %s = %q, want %q", tt.url, req.Host, tt.want)
+		}
+		if got := req.Header.Get("X-Forwarded-Host"); got != "lb.example" {
+			t.Errorf("X-Forwarded-Host proxied to %s = %q, want %q", tt.url, got, "lb.example")
+		}
+	}
+}
+
+func TestServerListedTwiceWithDefaultPort(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, `{
+		"servers": ["backend", "http://backend:80"],
+		"disableHealthChecks": true
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newState(config); err == nil {
+		t.Error("newState accepted a server listed with and without its default port")
+	}
+}
+
+func TestReloadKeepsUnchangedServers(t *testing.T) {
+	release := make(chan struct{})
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	})
+	other := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	config := `{
+		"servers": [{"url": %q, "weight": %d, "queue": {"maxInFlight": 1, "size": 1}}, {"url": %q}],
+		"healthCheckInterval": "1h"
+	}`
+	path := writeConfig(t, fmt.Sprintf(config, backend.URL, 1, other.URL))
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := newState(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := NewLoadBalancer(st)
+	t.Cleanup(func() { lb.State().Stop() })
+	server := st.Servers[0]
+
+	// A request in flight, then the server fails its checks.
+	done := make(chan int)
+	go func() {
+		done <- serve(lb, httptest.NewRequest("GET", "/slow", nil)).Code
+	}()
+	for active(server) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	server.Mu.Lock()
+	server.Healthy = false
+	server.Mu.Unlock()
+
+	// Only the weight changes.
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(config, backend.URL, 2, other.URL)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.Reload(path); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := lb.State().Servers[0]
+	if reloaded != server {
+		t.Fatal("reload replaced a server whose configuration did not change")
+	}
+	if pool := lb.State().Pools[defaultPoolName]; pool.Servers[0] != server {
+		t.Error("pool of the reloaded state does not contain the kept server")
+	}
+	if healthy(reloaded) {
+		t.Error("unhealthy server became healthy on reload")
+	}
+	if reloaded.Weight != 2 {
+		t.Errorf("weight after reload = %d, want 2", reloaded.Weight)
+	}
+	if n := active(reloaded); n != 1 {
+		t.Errorf("active connections after reload = %d, want 1", n)
+	}
+	if reloaded.Queue != server.Queue || len(reloaded.Queue.slots) != 1 {
+		t.Error("queue of the server was not kept with its request in flight")
+	}
+	for range 10 {
+		serve(lb, httptest.NewRequest("GET", "/", nil))
+	}
+	if n := reloaded.Requests.Load(); n != 1 {
+		t.Errorf("unhealthy server got %d requests after reload, want 1", n-1)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("request in flight during the reload got %d, want 200", code)
+	}
+	if n := active(reloaded); n != 0 {
+		t.Errorf("active connections once the request completed = %d, want 0", n)
+	}
+}
+
+func TestDisableHealthChecks(t *testing.T) {
+	var requests atomic.Int64
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"healthCheckInterval": "10ms",
+		"disableHealthChecks": true,
+		"algorithm": "weighted-random",
+		"errorWeightDecay": {"decay": 0.5, "recovery": 0.1}
+	}`, backend.URL))
+	server := lb.State().Servers[0]
+
+	time.Sleep(50 * time.Millisecond)
+	if n := requests.Load(); n != 0 {
+		t.Errorf("backend got %d probes, want none", n)
+	}
+	if !server.NextCheck.IsZero() {
+		t.Errorf("next check scheduled at %s", server.NextCheck)
+	}
+
+	// The failing server stays healthy, with a decayed weight.
+	serve(lb, httptest.NewRequest("GET", "/", nil))
+	server.Mu.Lock()
+	defer server.Mu.Unlock()
+	if !server.Healthy || server.WeightFactor != 0.5 {
+		t.Errorf("failing server healthy %v with weight factor %g, want true, 0.5", server.Healthy, server.WeightFactor)
+	}
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	config := fmt.Sprintf(`{"servers": [{"url": %q}], "disableHealthChecks": true}`, backend.URL)
+	path := writeConfig(t, config)
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := newState(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := NewLoadBalancer(st)
+	t.Cleanup(func() { lb.State().Stop() })
+
+	for _, tt := range []struct {
+		name, config string
+	}{
+		{"syntax error", `{"servers": [`},
+		{"no servers", `{"servers": []}`},
+		{"unknown algorithm", fmt.Sprintf(`{"servers": [{"url": %q}], "algorithm": "fastest"}`, backend.URL)},
+	} {
+		if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := lb.Reload(path); err == nil {
+			t.Errorf("reload with %s succeeded", tt.name)
+		}
+		if lb.State() != st {
+			t.Fatalf("reload with %s replaced the running configuration", tt.name)
+		}
+		if code := serve(lb, httptest.NewRequest("GET", "/", nil)).Code; code != http.StatusOK {
+			t.Errorf("request after the reload with %s: %d, want 200", tt.name, code)
+		}
+	}
+
+	if err := lb.Reload(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("reload of a missing file succeeded")
+	}
+	if lb.State() != st {
+		t.Error("reload of a missing file replaced the running configuration")
+	}
+}
+
+func TestPreserveHost(t *testing.T) {
+	var host, forwardedHost string
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		host, forwardedHost = r.Host, r.Header.Get("X-Forwarded-Host")
+	})
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"pools": {"api": {"servers": [{"url": %[1]q}], "preserveHost": false}},
+		"routes": [{"pathPrefix": "/api", "pool": "api"}],
+		"preserveHost": true,
+		"disableHealthChecks": true
+	}`, backend.URL))
+
+	for _, tt := range []struct {
+		path, host, forwardedHost string
+	}{
+		{"/", "example.com", ""},
+		{"/api", backendHost, "example.com"},
+	} {
+		host, forwardedHost = "", ""
+		serve(lb, httptest.NewRequest("GET", "http://example.com"+tt.path, nil))
+		if host != tt.host || forwardedHost != tt.forwardedHost {
+			t.Errorf("%s proxied with Host %q and X-Forwarded-Host %q, want %q and %q", tt.path, host, forwardedHost, tt.host, tt.forwardedHost)
+		}
+
+		// A client cannot choose the host the backends see.
+		host, forwardedHost = "", ""
+		r := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+		r.Header.Set("X-Forwarded-Host", "evil.example")
+		serve(lb, r)
+		if host != tt.host || forwardedHost != tt.forwardedHost {
+			t.Errorf("%s with a spoofed X-Forwarded-Host proxied with Host %q and X-Forwarded-Host %q, want %q and %q", tt.path, host, forwardedHost, tt.host, tt.forwardedHost)
+		}
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	next := make(chan struct{})
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("first,"))
+		http.NewResponseController(w).Flush()
+		<-next
+		w.Write([]byte("second"))
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Undeclared", "def")
+	})
+	// Rewriting would buffer the body.
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"responseRewrites": [{"contentType": "text/plain", "find": "first", "replace": "1st"}]
+	}`, backend.URL))
+	frontend := httptest.NewServer(lb)
+	t.Cleanup(frontend.Close)
+
+	res, err := http.Get(frontend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" {
+		t.Errorf("transfer encoding %v, want chunked", res.TransferEncoding)
+	}
+
+	// The first chunk arrives before the backend sends the rest, which
+	// it does after a while if the proxy waits for it.
+	var release sync.Once
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(2*time.Second, func() {
+		timedOut.Store(true)
+		release.Do(func() { close(next) })
+	})
+	defer timer.Stop()
+	first := make([]byte, len("first,"))
+	if _, err := io.ReadFull(res.Body, first); err != nil || string(first) != "first," {
+		t.Fatalf("first chunk %q, %v, want %q", first, err, "first,")
+	}
+	if timedOut.Load() {
+		t.Error("first chunk buffered until the end of the response")
+	}
+	release.Do(func() { close(next) })
+	rest, err := io.ReadAll(res.Body)
+	if err != nil || string(rest) != "second" {
+		t.Fatalf("rest of the body %q, %v, want %q", rest, err, "second")
+	}
+
+	for name, want := range map[string]string{"X-Checksum": "abc", "X-Undeclared": "def"} {
+		if got := res.Trailer.Get(name); got != want {
+			t.Errorf("trailer %s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestEmptyPool(t *testing.T) {
+	logs := captureLogs(t)
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	config := `{
+		"servers": [{"url": %q}],
+		"pools": {"api": {"servers": [%s]}},
+		"routes": [{"pathPrefix": "/api", "pool": "api"}],
+		"disableHealthChecks": true
+	}`
+	path := writeConfig(t, fmt.Sprintf(config, backend.URL, ""))
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := newState(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := NewLoadBalancer(st)
+	t.Cleanup(func() { lb.State().Stop() })
+
+	for range 3 {
+		if code := serve(lb, httptest.NewRequest("GET", "/api", nil)).Code; code != http.StatusServiceUnavailable {
+			t.Errorf("request to an empty pool got %d, want 503", code)
+		}
+	}
+	if !strings.Contains(logs.String(), `"msg":"Request to a pool without servers","pool":"api"`) {
+		t.Errorf("request to an empty pool not logged:\n%s", logs)
+	}
+	if code := serve(lb, httptest.NewRequest("GET", "/", nil)).Code; code != http.StatusOK {
+		t.Errorf("request to the default pool got %d, want 200", code)
+	}
+
+	// A server is added back.
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(config, backend.URL, fmt.Sprintf("%q", backend.URL))), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.Reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(lb, httptest.NewRequest("GET", "/api", nil)).Code; code != http.StatusOK {
+		t.Errorf("request after adding a server got %d, want 200", code)
+	}
+}
+
+func TestBalancersNoServers(t *testing.T) {
+	balancersMu.RLock()
+	algorithms := slices.Sorted(maps.Keys(balancers))
+	balancersMu.RUnlock()
+	for _, algorithm := range algorithms {
+		b, err := newBalancer(algorithm, BalancerOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server := b.Next(nil); server != nil {
+			t.Errorf("%s selected %s out of no servers", algorithm, server.URL)
+		}
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	st := newTestState(t, `{"servers": ["backend"], "disableHealthChecks": true, "streamingThresholdBytes": 1000}`)
+	for _, tt := range []struct {
+		contentLength int64
+		want          time.Duration
+	}{
+		{-1, -1},
+		{0, 0},
+		{1000, 0},
+		{1001, -1},
+	} {
+		if got := st.flushInterval(&http.Response{ContentLength: tt.contentLength}); got != tt.want {
+			t.Errorf("flushInterval of a %d byte response = %s, want %s", tt.contentLength, got, tt.want)
+		}
+	}
+}
+
+func TestStreamedResponse(t *testing.T) {
+	next := make(chan struct{})
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for range 3 {
+			fmt.Fprint(w, "data: event\n\n")
+			http.NewResponseController(w).Flush()
+			<-next
+		}
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true
+	}`, backend.URL))
+	frontend := httptest.NewServer(lb)
+	t.Cleanup(frontend.Close)
+
+	res, err := http.Get(frontend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	// Each event arrives before the backend sends the next one.
+	event := make([]byte, len("data: event\n\n"))
+	for i := range 3 {
+		done := make(chan error, 1)
+		go func() {
+			_, err := io.ReadFull(res.Body, event)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("reading event %d: %v", i, err)
+			}
+		case <-time.After(2 * time.Second):
+			close(next)
+			t.Fatalf("event %d not flushed", i)
+		}
+		next <- struct{}{}
+	}
+}
+
+func TestMaxBufferBytes(t *testing.T) {
+	const line = "see http://internal.example\n"
+	large := strings.Repeat(line, 200)
+	release := make(chan struct{})
+	var requests atomic.Int64
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "max-age=60")
+		switch r.URL.Path {
+		case "/small":
+			fmt.Fprint(w, line)
+		case "/large":
+			w.Header().Set("Content-Length", fmt.Sprint(len(large)))
+			fmt.Fprint(w, large)
+		case "/stream":
+			w.Header().Set("Content-Length", fmt.Sprint(len(large)))
+			fmt.Fprint(w, large[:len(large)/2])
+			http.NewResponseController(w).Flush()
+			<-release
+			fmt.Fprint(w, large[len(large)/2:])
+		}
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"responseRewrites": [{"contentType": "text/plain", "find": "http://internal.example", "replace": "https://www.example"}],
+		"cache": {"size": 10},
+		"maxBufferBytes": 1000,
+		"streamingThresholdBytes": 1000,
+		"disableHealthChecks": true
+	}`, backend.URL))
+
+	// Small responses are rewritten and cached, larger ones are passed
+	// through unchanged.
+	for _, tt := range []struct {
+		path, want string
+		cache      []string
+	}{
+		{"/small", "see https://www.example\n", []string{"MISS", "HIT"}},
+		{"/large", large, []string{"MISS", "MISS"}},
+	} {
+		for _, cache := range tt.cache {
+			w := serve(lb, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != http.StatusOK || w.Body.String() != tt.want {
+				t.Errorf("GET %s got %d with %d bytes, want 200 %q", tt.path, w.Code, w.Body.Len(), tt.want[:len(line)])
+			}
+			if got := w.Header().Get("X-Cache"); got != cache {
+				t.Errorf("GET %s: X-Cache = %q, want %q", tt.path, got, cache)
+			}
+		}
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("backend got %d requests, want 3", n)
+	}
+
+	// The beginning of a large response reaches the client before the
+	// backend sends the rest.
+	frontend := httptest.NewServer(lb)
+	t.Cleanup(frontend.Close)
+	t.Cleanup(func() { close(release) })
+	res, err := http.Get(frontend.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	first := make([]byte, len(large)/2)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(res.Body, first)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("beginning of the large response not streamed")
+	}
+	if string(first) != large[:len(large)/2] {
+		t.Error("large response rewritten")
+	}
+}
+
+func TestInformationalResponse(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Header().Set("Server", "backend")
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprint(w, "ok")
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"requestIDHeader": "X-Request-ID",
+		"stickySessions": true,
+		"serverHeader": "lb",
+		"cache": {"size": 10},
+		"disableHealthChecks": true
+	}`, backend.URL))
+	frontend := httptest.NewServer(lb)
+	t.Cleanup(frontend.Close)
+
+	var hints []int
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			hints = append(hints, code)
+			return nil
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(t.Context(), trace), "GET", frontend.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if !slices.Equal(hints, []int{http.StatusEarlyHints}) || res.StatusCode != http.StatusOK {
+		t.Fatalf("client got %v then %d, want 103 then 200", hints, res.StatusCode)
+	}
+
+	// The headers set by the load balancer survive the 1xx response.
+	if id := res.Header.Get("X-Request-ID"); id == "" {
+		t.Error("response has no request ID")
+	}
+	if got := res.Header.Get("Server"); got != "lb" {
+		t.Errorf("Server = %q, want lb", got)
+	}
+	if got := res.Header.Get("X-Cache"); got != "MISS" {
+		t.Errorf("X-Cache = %q, want MISS", got)
+	}
+	if cookies := res.Cookies(); len(cookies) != 1 || cookies[0].Name != stickyCookieName {
+		t.Errorf("cookies %v, want the affinity cookie", cookies)
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx")
+	})
+	for _, tt := range []struct {
+		name, config    string
+		proxied, failed string
+	}{
+		{"unset", "", "nginx", ""},
+		{"replaced", `"serverHeader": "lb",`, "lb", "lb"},
+		{"removed", `"serverHeader": "",`, "", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}],
+				"pools": {"down": {"servers": ["127.0.0.1:1"]}},
+				"routes": [{"pathPrefix": "/down", "pool": "down"}],
+				%s
+				"disableHealthChecks": true
+			}`, backend.URL, tt.config))
+
+			if got := serve(lb, httptest.NewRequest("GET", "/", nil)).Header().Values("Server"); strings.Join(got, ",") != tt.proxied {
+				t.Errorf("proxied response has Server %q, want %q", got, tt.proxied)
+			}
+			// The responses of the load balancer itself.
+			w := serve(lb, httptest.NewRequest("GET", "/down", nil))
+			if w.Code != http.StatusBadGateway {
+				t.Fatalf("request to a server down got %d, want 502", w.Code)
+			}
+			if got := w.Header().Get("Server"); got != tt.failed {
+				t.Errorf("error response has Server %q, want %q", got, tt.failed)
+			}
+		})
+	}
+}
+
+func TestServerURLPath(t *testing.T) {
+	var got string
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+	})
+	for _, tt := range []struct {
+		server, path, want string
+	}{
+		// The path of the server prefixes the proxied paths.
+		{"/app", "/", "/app/"},
+		{"/app", "/users?page=2", "/app/users?page=2"},
+		{"/app/", "/users", "/app/users"},
+		{"//app//", "/users", "/app/users"},
+		{"/app", "/a%2Fb", "/app/a%2Fb"},
+		{"/app/v1", "/users", "/app/v1/users"},
+		{"", "/users", "/users"},
+	} {
+		got = ""
+		lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+			"servers": [{"url": %q}],
+			"disableHealthChecks": true
+		}`, backend.URL+tt.server))
+		if code := serve(lb, httptest.NewRequest("GET", tt.path, nil)).Code; code != http.StatusOK {
+			t.Errorf("%s to %s got %d, want 200", tt.path, tt.server, code)
+		}
+		if got != tt.want {
+			t.Errorf("%s to the server with the path %q proxied as %s, want %s", tt.path, tt.server, got, tt.want)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") != "100-continue" {
+			t.Errorf("backend got Expect %q, want 100-continue", r.Header.Get("Expect"))
+		}
+		if r.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// Reading the body sends 100 Continue.
+		io.Copy(w, r.Body)
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"expectContinueTimeout": "5s",
+		"disableHealthChecks": true
+	}`, backend.URL))
+	frontend := httptest.NewServer(lb)
+	t.Cleanup(frontend.Close)
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/upload", http.StatusOK, "payload"},
+		// The body is never sent.
+		{"/reject", http.StatusUnauthorized, ""},
+	} {
+		conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: lb\r\nContent-Length: 7\r\nExpect: 100-continue\r\n\r\n", tt.path)
+
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.status == http.StatusOK {
+			if res.StatusCode != http.StatusContinue {
+				t.Fatalf("%s: got %d before sending the body, want 100", tt.path, res.StatusCode)
+			}
+			fmt.Fprint(conn, "payload")
+			if res, err = http.ReadResponse(br, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.status || string(body) != tt.body {
+			t.Errorf("%s: got %d %q, want %d %q", tt.path, res.StatusCode, body, tt.status, tt.body)
+		}
+	}
+
+	if transport := newTransport(Config{ExpectContinueTimeout: Duration(3 * time.Second)}).(*http.Transport); transport.ExpectContinueTimeout != 3*time.Second {
+		t.Errorf("transport ExpectContinueTimeout = %s, want 3s", transport.ExpectContinueTimeout)
+	}
+	c, err := loadConfig(writeConfig(t, `{"servers": ["backend:80"], "expectContinueTimeout": "-1s", "disableHealthChecks": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newState(c); err == nil || !strings.Contains(err.Error(), "expectContinueTimeout") {
+		t.Errorf("state with a negative expectContinueTimeout: %v, want an expectContinueTimeout error", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// newLogger returns a logger writing to w in the given format, discarding
+// records below level and collapsing warnings and errors repeated within
+// repeatInterval. A zero repeatInterval disables collapsing.
+func newLogger(w io.Writer, format, level string, repeatInterval time.Duration) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("parsing logLevel: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+
+	var h slog.Handler
+	switch format {
+	case logFormatText:
+		h = slog.NewTextHandler(w, opts)
+	case logFormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("parsing logFormat: unknown format %q", format)
+	}
+
+	if repeatInterval > 0 {
+		h = &dedupHandler{Handler: h, interval: repeatInterval, state: &dedupState{counts: map[string]int{}}}
+	}
+	return slog.New(h), nil
+}
+
+// dedupHandler collapses identical warnings and errors, e.g. errors of a
+// server that is down: the first record is logged, and the number of
+// identical records logged within interval is logged once it has elapsed.
+type dedupHandler struct {
+	slog.Handler
+	interval time.Duration
+	// prefix identifies the attributes and groups of the handler.
+	prefix string
+	state  *dedupState
+}
+
+// dedupState counts the records collapsed by the dedupHandlers
+// sharing it, by key.
+type dedupState struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// Handle logs r unless an identical record was logged within the interval.
+func (h *dedupHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.Handler.Handle(ctx, r)
+	}
+
+	key := h.key(r)
+	h.state.mu.Lock()
+	if _, ok := h.state.counts[key]; ok {
+		h.state.counts[key]++
+		h.state.mu.Unlock()
+		return nil
+	}
+	h.state.counts[key] = 0
+	h.state.mu.Unlock()
+
+	r = r.Clone()
+	time.AfterFunc(h.interval, func() {
+		h.state.mu.Lock()
+		n := h.state.counts[key]
+		delete(h.state.counts, key)
+		h.state.mu.Unlock()
+
+		if n > 0 {
+			summary := r.Clone()
+			summary.Time = time.Now()
+			summary.AddAttrs(slog.Int("repeated", n), slog.String("interval", h.interval.String()))
+			_ = h.Handler.Handle(context.Background(), summary)
+		}
+	})
+
+	return h.Handler.Handle(ctx, r)
+}
+
+// key returns the key of the records identical to r.
+func (h *dedupHandler) key(r slog.Record) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s%s %s", h.prefix, r.Level, r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	})
+	return b.String()
+}
+
+// WithAttrs returns a handler adding attrs to the records.
+func (h *dedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefix := h.prefix
+	for _, a := range attrs {
+		prefix += fmt.Sprintf("%s=%v ", a.Key, a.Value)
+	}
+	return &dedupHandler{Handler: h.Handler.WithAttrs(attrs), interval: h.interval, prefix: prefix, state: h.state}
+}
+
+// WithGroup returns a handler grouping the attributes of the records.
+func (h *dedupHandler) WithGroup(name string) slog.Handler {
+	return &dedupHandler{Handler: h.Handler.WithGroup(name), interval: h.interval, prefix: h.prefix + name + ". ", state: h.state}
+}
+
+// fatal logs msg with args at the error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useLogger makes l the default logger until the end of the test.
+func useLogger(t *testing.T, l *slog.Logger) {
+	t.Helper()
+	previous := slog.Default()
+	slog.SetDefault(l)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+}
+
+// records returns the JSON log records in logs.
+func records(t *testing.T, logs string) []map[string]any {
+	t.Helper()
+	var result []map[string]any
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("decoding log record %s: %v", scanner.Text(), err)
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+func TestJSONHealthTransitionLogs(t *testing.T) {
+	logs := &logBuffer{}
+	l, err := newLogger(logs, logFormatJSON, "info", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useLogger(t, l)
+
+	var failing atomic.Bool
+	backendURL := failingBackend(t, &failing)
+	st := newTestState(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"healthCheckInterval": "1h"
+	}`, backendURL))
+	server := st.Servers[0]
+	failing.Store(true)
+	st.healthChecker.Update(t.Context(), server)
+	failing.Store(false)
+	st.healthChecker.Update(t.Context(), server)
+
+	want := map[string][]string{
+		"Server became unhealthy": {"time", "level", "msg", "server", "statusCode", "error"},
+		"Server became healthy":   {"time", "level", "msg", "server"},
+	}
+	for _, record := range records(t, logs.String()) {
+		keys, ok := want[record["msg"].(string)]
+		if !ok {
+			continue
+		}
+		delete(want, record["msg"].(string))
+		for _, key := range keys {
+			if _, ok := record[key]; !ok {
+				t.Errorf("%q log has no %s: %v", record["msg"], key, record)
+			}
+		}
+		if record["server"] != backendURL {
+			t.Errorf("%q log has server %v, want %s", record["msg"], record["server"], backendURL)
+		}
+	}
+	for msg := range want {
+		t.Errorf("no %q log:\n%s", msg, logs)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	logs := &logBuffer{}
+	l, err := newLogger(logs, logFormatText, "warn", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info("hidden")
+	l.Warn("shown", "server", "a")
+	if got := logs.String(); strings.Contains(got, "hidden") || !strings.Contains(got, "level=WARN msg=shown server=a") {
+		t.Errorf("text logs at the warn level:\n%s", got)
+	}
+
+	for _, tt := range []struct {
+		format, level string
+	}{
+		{"xml", "info"},
+		{logFormatJSON, "verbose"},
+	} {
+		if _, err := newLogger(logs, tt.format, tt.level, 0); err == nil {
+			t.Errorf("newLogger with format %q and level %q succeeded", tt.format, tt.level)
+		}
+	}
+}
+
+func TestDedupHandler(t *testing.T) {
+	logs := &logBuffer{}
+	l, err := newLogger(logs, logFormatJSON, "info", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 50 {
+		l.Error("Error proxying", "server", "http://a", "error", "connection refused")
+		l.Error("Error proxying", "server", "http://b", "error", "connection refused")
+		// Only warnings and errors are collapsed.
+		l.Info("Request", "server", "http://a")
+	}
+	l.With("pool", "api").Error("Error proxying", "server", "http://a", "error", "connection refused")
+
+	got := records(t, logs.String())
+	counts := map[string]int{}
+	for _, record := range got {
+		counts[fmt.Sprintf("%v %v %v", record["msg"], record["server"], record["pool"])]++
+	}
+	for key, want := range map[string]int{
+		"Error proxying http://a <nil>": 1,
+		"Error proxying http://b <nil>": 1,
+		"Error proxying http://a api":   1,
+		"Request http://a <nil>":        50,
+	} {
+		if counts[key] != want {
+			t.Errorf("%s logged %d times, want %d", key, counts[key], want)
+		}
+	}
+
+	// The repeated records are summarized once the interval elapsed.
+	time.Sleep(200 * time.Millisecond)
+	summaries := 0
+	for _, record := range records(t, logs.String())[len(got):] {
+		if record["msg"] != "Error proxying" || record["repeated"] != float64(49) || record["interval"] != "100ms" {
+			t.Errorf("summary %v, want the error repeated 49 times in 100ms", record)
+		}
+		summaries++
+	}
+	if summaries != 2 {
+		t.Errorf("%d summaries, want 2", summaries)
+	}
+}
+
+func TestAccessLogSampleRate(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	for _, tt := range []struct {
+		name             string
+		config           string
+		minLogs, maxLogs int
+	}{
+		{"default", "", 1000, 1000},
+		{"half", `"accessLogSampleRate": 0.5,`, 400, 600},
+		{"none", `"accessLogSampleRate": 0,`, 0, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}],
+				"accessLog": true,
+				%s
+				"disableHealthChecks": true
+			}`, backend.URL, tt.config))
+			for range 1000 {
+				serve(lb, httptest.NewRequest("GET", "/", nil))
+			}
+			// Errors are always logged.
+			for range 10 {
+				serve(lb, httptest.NewRequest("GET", "/error", nil))
+			}
+
+			var successes, failures int
+			for _, record := range records(t, logs.String()) {
+				if record["msg"] != "Request" {
+					continue
+				}
+				if record["status"] == 200.0 {
+					successes++
+				} else {
+					failures++
+				}
+			}
+			if successes < tt.minLogs || successes > tt.maxLogs {
+				t.Errorf("%d of 1000 successful requests logged, want between %d and %d", successes, tt.minLogs, tt.maxLogs)
+			}
+			if failures != 10 {
+				t.Errorf("%d of 10 failed requests logged, want 10", failures)
+			}
+		})
+	}
+
+	for _, rate := range []float64{-0.1, 1.5} {
+		if _, err := newAccessLog(Config{AccessLog: true, AccessLogSampleRate: &rate}); err == nil {
+			t.Errorf("newAccessLog with the sample rate %g succeeded", rate)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// mainArgsEnv holds the newline-separated arguments of main when the test
+// binary is run by runMain.
+const mainArgsEnv = "GOLOADBALANCER_MAIN_ARGS"
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(mainArgsEnv); ok {
+		os.Args = append([]string{os.Args[0]}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	// The tests checking logs set their own logger.
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// logBuffer collects the logs of a test.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write implements io.Writer.
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// String returns the logs collected so far.
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs collects the logs written until the end of the test, in
+// the JSON format.
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	logs := &logBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+// mainCommand returns the command running main with args in a new process.
+func mainCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+strings.Join(args, "\n"))
+	return cmd
+}
+
+// runMain runs main with args in a new process, and returns its output
+// and exit code.
+func runMain(t *testing.T, stdin io.Reader, args ...string) (string, int) {
+	t.Helper()
+	cmd := mainCommand(args...)
+	cmd.Stdin = stdin
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		return string(out), exitErr.ExitCode()
+	case err != nil:
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+// writeConfig writes config to a temporary file and returns its path.
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestState returns the state described by config, with the defaults
+// of loadConfig.
+func newTestState(t *testing.T, config string) *State {
+	t.Helper()
+	c, err := loadConfig(writeConfig(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := newState(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// newTestLoadBalancer returns a load balancer running config, stopped at
+// the end of the test.
+func newTestLoadBalancer(t *testing.T, config string) *LoadBalancer {
+	t.Helper()
+	lb := NewLoadBalancer(newTestState(t, config))
+	t.Cleanup(func() { lb.State().Stop() })
+	return lb
+}
+
+// newBackend returns a backend served by handler, closed at the end of
+// the test.
+func newBackend(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// serve serves r by h and returns the response.
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestTimeoutHeader(t *testing.T) {
+	var got []string
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get(timeoutHeader))
+	})
+	for _, tt := range []struct {
+		name, config string
+		min, max     int
+	}{
+		{"backend timeout", `, "backendTimeout": "2s"`, 1900, 2000},
+		{"no timeout", "", -1, -1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}],
+				"disableHealthChecks": true%s
+			}`, backend.URL, tt.config))
+			r := httptest.NewRequest("GET", "/", nil)
+			// Sent by the client.
+			r.Header.Set(timeoutHeader, "999999")
+			serve(lb, r)
+
+			if len(got) != 1 {
+				t.Fatalf("backend got %d requests, want 1", len(got))
+			}
+			if tt.min < 0 {
+				if got[0] != "" {
+					t.Errorf("%s = %q, want none", timeoutHeader, got[0])
+				}
+				return
+			}
+			ms, err := strconv.Atoi(got[0])
+			if err != nil || ms < tt.min || ms > tt.max {
+				t.Errorf("%s = %q, want between %d and %d", timeoutHeader, got[0], tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestTimeoutHeaderRetries(t *testing.T) {
+	var got []int
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		ms, _ := strconv.Atoi(r.Header.Get(timeoutHeader))
+		got = append(got, ms)
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"backendTimeout": "2s",
+		"maxRetries": 2,
+		"retryOnStatus": [503]
+	}`, backend.URL))
+	serve(lb, httptest.NewRequest("GET", "/", nil))
+
+	if len(got) != 3 {
+		t.Fatalf("backend got %d attempts, want 3", len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] > got[i-1]-40 {
+			t.Errorf("attempt %d got %s = %d after %d, want it shrinking", i, timeoutHeader, got[i], got[i-1])
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name, config string
+		code         int
+		output       string
+	}{
+		{"valid", `{
+			"servers": ["backend-1:8080", "backend-2:8080"],
+			"pools": {"api": {"servers": ["api:8080"]}},
+			"routes": [{"pathPrefix": "/api", "pool": "api"}],
+			"healthCheckInterval": "10s"
+		}`, 0, "is valid: 1 listeners, 2 pools, 3 servers, 1 routes"},
+		{"syntax error", `{"servers": [`, 1, "Error loading configuration"},
+		{"server listed twice", `{"servers": ["backend:8080", "http://backend:8080"], "healthCheckInterval": "10s"}`, 1, "listed twice"},
+		{"invalid duration", `{"servers": ["backend"], "healthCheckInterval": "often"}`, 1, "Error loading configuration"},
+		{"no health check interval", `{"servers": ["backend"]}`, 1, "healthCheckInterval"},
+		{"unknown pool", `{"servers": ["backend"], "routes": [{"pathPrefix": "/api", "pool": "api"}], "healthCheckInterval": "10s"}`, 1, "unknown pool"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out, code := runMain(t, nil, "-validate", "-config", writeConfig(t, tt.config))
+			if code != tt.code || !strings.Contains(out, tt.output) {
+				t.Errorf("-validate exited with %d and output:\n%s\nwant %d and %q", code, out, tt.code, tt.output)
+			}
+		})
+	}
+}
+
+func TestConfigStdin(t *testing.T) {
+	config := `{"servers": ["backend-1:8080", "backend-2:8080"], "healthCheckInterval": "10s"}`
+	out, code := runMain(t, strings.NewReader(config), "-validate", "-config", "-")
+	if code != 0 || !strings.Contains(out, "2 servers") {
+		t.Errorf("-validate of stdin exited with %d and output:\n%s\nwant 0 and 2 servers", code, out)
+	}
+	out, code = runMain(t, strings.NewReader(`{"servers": [`), "-validate", "-config", "-")
+	if code != 1 || !strings.Contains(out, "Error loading configuration") {
+		t.Errorf("-validate of invalid stdin exited with %d and output:\n%s\nwant 1", code, out)
+	}
+}
+
+func TestConfigURL(t *testing.T) {
+	release := make(chan struct{})
+	source := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/config.json":
+			fmt.Fprint(w, `{"servers": ["backend:8080"], "healthCheckInterval": "10s"}`)
+		case "/large.json":
+			w.Write(bytes.Repeat([]byte(" "), maxConfigBytes+1))
+		case "/slow.json":
+			<-release
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	// The slow handler returns before the backend is closed.
+	t.Cleanup(func() { close(release) })
+	config, err := loadConfig(source.URL + "/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Servers) != 1 || config.Algorithm != "least-connections" {
+		t.Errorf("fetched configuration %+v, want 1 server and the defaults", config)
+	}
+
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"/missing.json", "unexpected status 404 Not Found"},
+		{"/large.json", "larger than"},
+	} {
+		if _, err := loadConfig(source.URL + tt.path); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("loadConfig(%s) = %v, want an error %q", tt.path, err, tt.want)
+		}
+	}
+
+	previous := configFetchTimeout
+	configFetchTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { configFetchTimeout = previous })
+	if _, err := loadConfig(source.URL + "/slow.json"); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("loadConfig(/slow.json) = %v, want the fetch timed out", err)
+	}
+}
+
+func TestShutdownDelay(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	address, adminAddress := freeAddress(t), freeAddress(t)
+	cmd := mainCommand("-config", writeConfig(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"listenPort": %q,
+		"admin": {"listenPort": %q},
+		"shutdownDelay": "500ms"
+	}`, backend.URL, address, adminAddress)))
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		exited <- cmd.Wait()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		<-done
+	})
+
+	// get returns the status code of a GET request to url.
+	//
+	// Connections are not kept alive: a connection dialed for a request
+	// but not used, as another became idle first, would delay the shutdown
+	// by 5s, until the server considers it idle.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(url string) int {
+		res, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	res, err := getWhenListening(t, "http://"+adminAddress+"/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("readiness before the shutdown: %d, want 200", res.StatusCode)
+	}
+
+	start := time.Now()
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	// Readiness fails first, while requests are still proxied.
+	for get("http://"+adminAddress+"/readyz") != http.StatusServiceUnavailable {
+		if time.Since(start) > 400*time.Millisecond {
+			t.Fatal("readiness still passing during the shutdown delay")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if code := get("http://" + address); code != http.StatusOK {
+		t.Errorf("request during the shutdown delay got %d, want 200", code)
+	}
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("load balancer exited with %v", err)
+		}
+		if d := time.Since(start); d < 500*time.Millisecond {
+			t.Errorf("load balancer exited %s after SIGTERM, want after the shutdown delay", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("load balancer still running after the shutdown delay")
+	}
+}
+
+func TestLogSummary(t *testing.T) {
+	logs := captureLogs(t)
+	path := writeConfig(t, `{
+		"servers": ["backend-1:8080", "backend-2:8080"],
+		"algorithm": "p2c",
+		"pools": {"api": {"servers": ["api:8080", "backend-1:8080"]}},
+		"routes": [{"pathPrefix": "/api", "pool": "api"}],
+		"listeners": [{"address": ":8080"}, {"address": ":8443", "tlsCert": "cert.pem", "tlsKey": "key.pem"}],
+		"healthCheckInterval": "5s",
+		"admin": {"listenPort": ":9090", "password": "secret"}
+	}`)
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := newStartupOptions(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := newState(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logSummary(path, c, opts, st)
+
+	var record map[string]any
+	if err := json.Unmarshal([]byte(logs.String()), &record); err != nil {
+		t.Fatalf("decoding %s: %v", logs, err)
+	}
+	want := map[string]any{
+		"msg":                 "Configuration loaded",
+		"config":              path,
+		"algorithm":           "p2c",
+		"pools":               2.0,
+		"servers":             3.0,
+		"routes":              1.0,
+		"healthCheckInterval": "5s",
+		"listeners":           []any{":8080", ":8443"},
+		"tls":                 true,
+		"admin":               true,
+		"metrics":             true,
+		"statsd":              false,
+	}
+	for key, value := range want {
+		if !reflect.DeepEqual(record[key], value) {
+			t.Errorf("%s = %v, want %v", key, record[key], value)
+		}
+	}
+	if strings.Contains(logs.String(), "secret") {
+		t.Errorf("summary shows a secret:\n%s", logs)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"30s", 30 * time.Second, true},
+		{"1.5", 1500 * time.Millisecond, true},
+		{"2m", time.Minute, true},
+		{"90", time.Minute, true},
+		{"1e300", time.Minute, true},
+		{"0", 0, false},
+		{"-5s", 0, false},
+		{"NaN", 0, false},
+		{"soon", 0, false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			r.Header.Set(requestTimeoutHeader, tt.header)
+		}
+		d, ok := requestTimeout(r, time.Minute)
+		if d != tt.want || ok != tt.ok {
+			t.Errorf("requestTimeout with %q = %s, %v, want %s, %v", tt.header, d, ok, tt.want, tt.ok)
+		}
+		if r.Header.Get(requestTimeoutHeader) != "" {
+			t.Errorf("%s header %q not removed", requestTimeoutHeader, tt.header)
+		}
+	}
+}
+
+func TestRequestTimeoutProxied(t *testing.T) {
+	var remaining, requested string
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		remaining = r.Header.Get(timeoutHeader)
+		requested = r.Header.Get(requestTimeoutHeader)
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"backendTimeout": "1s",
+		"maxRequestTimeout": "5s",
+		"disableHealthChecks": true
+	}`, backend.URL))
+
+	for _, tt := range []struct {
+		name, header string
+		want         int
+	}{
+		{"within the cap", "3s", 3000},
+		{"above the cap", "10", 5000},
+		{"invalid", "later", 1000},
+		{"none", "", 1000},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set(requestTimeoutHeader, tt.header)
+			}
+			serve(lb, r)
+			ms, err := strconv.Atoi(remaining)
+			if err != nil || ms > tt.want || ms < tt.want-100 {
+				t.Errorf("%s = %q, want about %d", timeoutHeader, remaining, tt.want)
+			}
+			if requested != "" {
+				t.Errorf("%s %q sent to the server", requestTimeoutHeader, requested)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// defaultMaintenanceBody is the page served in maintenance mode when no
+// body is configured.
+const defaultMaintenanceBody = "Service under maintenance, please try again later.\n"
+
+// MaintenanceConfig represents the configuration of the maintenance mode.
+type MaintenanceConfig struct {
+	// Enabled answers the requests with the maintenance page and a 503
+	// status code instead of proxying them.
+	Enabled bool `json:"enabled"`
+	// Body of the maintenance page.
+	Body string `json:"body"`
+	// Allow contains the IPs and CIDRs of the clients whose requests are
+	// proxied anyway, e.g. to verify a fix.
+	Allow []string `json:"allow"`
+}
+
+// maintenance answers the requests of the clients that are not allowed
+// with the maintenance page.
+type maintenance struct {
+	page  *staticResponse
+	allow prefixSet
+}
+
+// newMaintenance returns the maintenance mode described by config, or nil
+// if it is disabled.
+func newMaintenance(config *MaintenanceConfig) (*maintenance, error) {
+	if config == nil {
+		return nil, nil
+	}
+	allow, err := parsePrefixes(config.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("parsing maintenance.allow: %w", err)
+	}
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	body := []byte(config.Body)
+	if len(body) == 0 {
+		body = []byte(defaultMaintenanceBody)
+	}
+	page := &staticResponse{
+		status:      http.StatusServiceUnavailable,
+		contentType: http.DetectContentType(body),
+		body:        body,
+	}
+	return &maintenance{page: page, allow: allow}, nil
+}
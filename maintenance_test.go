@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "backend")
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"trustedProxies": ["10.0.0.1"],
+		"maintenance": {"enabled": true, "body": "<h1>Back soon</h1>", "allow": ["192.0.2.0/24", "2001:db8::1"]}
+	}`, backend.URL))
+
+	for _, tt := range []struct {
+		name, remoteAddr, forwardedFor string
+		allowed                        bool
+	}{
+		{"allowed network", "192.0.2.7:1234", "", true},
+		{"allowed IPv6", "[2001:db8::1]:1234", "", true},
+		{"other client", "198.51.100.1:1234", "", false},
+		{"allowed behind a trusted proxy", "10.0.0.1:1234", "192.0.2.7", true},
+		{"other client behind a trusted proxy", "10.0.0.1:1234", "198.51.100.1", false},
+		{"spoofed forwarded for", "198.51.100.1:1234", "192.0.2.7", false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		w := serve(lb, r)
+		switch {
+		case tt.allowed && (w.Code != http.StatusOK || w.Body.String() != "backend"):
+			t.Errorf("%s got %d %q, want the request proxied", tt.name, w.Code, w.Body)
+		case !tt.allowed && (w.Code != http.StatusServiceUnavailable || w.Body.String() != "<h1>Back soon</h1>"):
+			t.Errorf("%s got %d %q, want the maintenance page", tt.name, w.Code, w.Body)
+		case !tt.allowed && w.Header().Get("Content-Type") != "text/html; charset=utf-8":
+			t.Errorf("%s got the maintenance page as %q, want text/html", tt.name, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestNewMaintenance(t *testing.T) {
+	if m, err := newMaintenance(&MaintenanceConfig{Allow: []string{"192.0.2.0/24"}}); m != nil || err != nil {
+		t.Errorf("newMaintenance of a disabled mode = %v, %v, want nil", m, err)
+	}
+	// Invalid allowlists are rejected even when disabled.
+	for _, enabled := range []bool{false, true} {
+		if _, err := newMaintenance(&MaintenanceConfig{Enabled: enabled, Allow: []string{"192.0.2.0/33"}}); err == nil {
+			t.Errorf("newMaintenance with an invalid allowlist, enabled %v, succeeded", enabled)
+		}
+	}
+	m, err := newMaintenance(&MaintenanceConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.page.body) != defaultMaintenanceBody {
+		t.Errorf("maintenance page %q, want the default one", m.page.body)
+	}
+}
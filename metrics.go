@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricLabelName matches the valid label names.
+var metricLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabelNames contains the label names set by the load balancer,
+// which the servers cannot be labeled with.
+var reservedLabelNames = map[string]bool{"server": true, "route": true, "code": true, "le": true}
+
+// labelValueEscaper escapes label values in the Prometheus text format.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// defaultBuckets are the upper bounds of the histogram buckets, in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// unmatchedRoute is the route label of requests matching no route.
+const unmatchedRoute = "unmatched"
+
+// Metrics contains the request metrics.
+//
+// They are kept across configuration reloads.
+type Metrics struct {
+	// Requests counts requests by route and status code.
+	Requests *counterVec
+	// RequestDuration observes request durations by route.
+	RequestDuration *histogramVec
+	// RequestErrors counts requests answered with a 5xx status code by route.
+	RequestErrors *counterVec
+	// QueueWait observes the time requests wait in the queue.
+	QueueWait *histogramVec
+	// HealthCheckDuration observes the durations of the health checks by
+	// server.
+	HealthCheckDuration *histogramVec
+	// HealthCheckFailures counts the failed health checks by server.
+	HealthCheckFailures *counterVec
+}
+
+// NewMetrics returns empty metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Requests: newCounterVec("lb_requests_total",
+			"Total number of requests."),
+		RequestDuration: newHistogramVec("lb_request_duration_seconds",
+			"Duration of requests in seconds.", defaultBuckets),
+		RequestErrors: newCounterVec("lb_request_errors_total",
+			"Total number of requests answered with a 5xx status code."),
+		QueueWait: newHistogramVec("lb_queue_wait_seconds",
+			"Time requests waited in the queue in seconds.", defaultBuckets),
+		HealthCheckDuration: newHistogramVec("lb_health_check_duration_seconds",
+			"Duration of health checks in seconds.", defaultBuckets),
+		HealthCheckFailures: newCounterVec("lb_health_check_failures_total",
+			"Total number of failed health checks."),
+	}
+}
+
+// ObserveRequest records a request handled by route.
+func (m *Metrics) ObserveRequest(route string, status int, d time.Duration) {
+	m.Requests.Add(labels("route", route, "code", strconv.Itoa(status)), 1)
+	m.RequestDuration.Observe(labels("route", route), d.Seconds())
+	if status >= 500 {
+		m.RequestErrors.Add(labels("route", route), 1)
+	}
+}
+
+// ObserveHealthCheck records a health check of s.
+func (m *Metrics) ObserveHealthCheck(s *Server, result checkResult) {
+	l := labels(serverLabels(s)...)
+	m.HealthCheckDuration.Observe(l, result.Latency.Seconds())
+	if !result.Healthy {
+		m.HealthCheckFailures.Add(l, 1)
+	}
+}
+
+// writeMetrics writes the metrics of lb in the Prometheus text format.
+func writeMetrics(w io.Writer, lb *LoadBalancer) {
+	st := lb.State()
+
+	lb.Metrics.Requests.write(w)
+	lb.Metrics.RequestDuration.write(w)
+	lb.Metrics.RequestErrors.write(w)
+	lb.Metrics.QueueWait.write(w)
+	lb.Metrics.HealthCheckDuration.write(w)
+	lb.Metrics.HealthCheckFailures.write(w)
+
+	var depth int64
+	if st.Queue != nil {
+		depth = st.Queue.Depth()
+	}
+	fmt.Fprintf(w, "# HELP lb_queue_depth Number of requests waiting in the queue.\n# TYPE lb_queue_depth gauge\nlb_queue_depth %d\n", depth)
+
+	fmt.Fprintf(w, "# HELP lb_healthy_servers Number of healthy servers.\n# TYPE lb_healthy_servers gauge\nlb_healthy_servers %d\n", countHealthy(st.Servers))
+	if st.Config.MinHealthyServers > 0 {
+		below := 0
+		if st.belowMinHealthy.Load() {
+			below = 1
+		}
+		fmt.Fprintf(w, "# HELP lb_healthy_servers_below_minimum Whether fewer servers than minHealthyServers are healthy (1) or not (0).\n# TYPE lb_healthy_servers_below_minimum gauge\nlb_healthy_servers_below_minimum %d\n", below)
+	}
+
+	writeServerMetric(w, "lb_server_healthy", "gauge",
+		"Whether the server is healthy (1) or not (0).",
+		st.Servers, func(s *Server) float64 {
+			s.Mu.Lock()
+			defer s.Mu.Unlock()
+			if s.Healthy {
+				return 1
+			}
+			return 0
+		})
+	writeServerMetric(w, "lb_server_active_connections", "gauge",
+		"Number of requests currently proxied to the server.",
+		st.Servers, func(s *Server) float64 {
+			s.Mu.Lock()
+			defer s.Mu.Unlock()
+			return float64(s.ActiveConnections)
+		})
+	writeServerMetric(w, "lb_server_requests_total", "counter",
+		"Total number of requests proxied to the server, counting each attempt.",
+		st.Servers, func(s *Server) float64 { return float64(s.Requests.Load()) })
+	writeServerMetric(w, "lb_server_request_bytes_total", "counter",
+		"Total bytes of request bodies sent to the server.",
+		st.Servers, func(s *Server) float64 { return float64(s.RequestBytes.Load()) })
+	writeServerMetric(w, "lb_server_response_bytes_total", "counter",
+		"Total bytes of response bodies received from the server.",
+		st.Servers, func(s *Server) float64 { return float64(s.ResponseBytes.Load()) })
+
+	var tlsServers []*Server
+	for _, s := range st.Servers {
+		s.Mu.Lock()
+		if !s.LastCheck.CertExpiry.IsZero() {
+			tlsServers = append(tlsServers, s)
+		}
+		s.Mu.Unlock()
+	}
+	writeServerMetric(w, "lb_server_cert_expiry_timestamp_seconds", "gauge",
+		"Expiry of the TLS certificate of the server observed by health checks, as a Unix timestamp.",
+		tlsServers, func(s *Server) float64 {
+			s.Mu.Lock()
+			defer s.Mu.Unlock()
+			return float64(s.LastCheck.CertExpiry.Unix())
+		})
+}
+
+// writeServerMetric writes a metric with one sample per server.
+func writeServerMetric(w io.Writer, name, typ, help string, servers []*Server, value func(*Server) float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, s := range servers {
+		fmt.Fprintf(w, "%s{%s} %g\n", name, labels(serverLabels(s)...), value(s))
+	}
+}
+
+// serverLabels returns the label pairs of the metrics of s, given as
+// name and value alternately: its URL then its configured labels.
+func serverLabels(s *Server) []string {
+	kv := []string{"server", s.RedactedURL()}
+	for _, name := range slices.Sorted(maps.Keys(s.Labels)) {
+		kv = append(kv, name, s.Labels[name])
+	}
+	return kv
+}
+
+// labels returns the label pairs kv, given as name and value
+// alternately, in the Prometheus text format.
+func labels(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", kv[i], labelValueEscaper.Replace(kv[i+1]))
+	}
+	return b.String()
+}
+
+// counterVec is a counter partitioned by labels.
+type counterVec struct {
+	name string
+	help string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// newCounterVec returns an empty counterVec.
+func newCounterVec(name, help string) *counterVec {
+	return &counterVec{name: name, help: help, values: make(map[string]float64)}
+}
+
+// Add adds v to the counter with the given labels.
+func (c *counterVec) Add(labels string, v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labels] += v
+}
+
+// snapshot returns the values of the counter by labels.
+func (c *counterVec) snapshot() map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.values)
+}
+
+// write writes the counter in the Prometheus text format.
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, l := range slices.Sorted(maps.Keys(c.values)) {
+		fmt.Fprintf(w, "%s{%s} %g\n", c.name, l, c.values[l])
+	}
+}
+
+// histogram represents the observations of a histogramVec for some labels.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a histogram partitioned by labels.
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+// newHistogramVec returns an empty histogramVec with the given bucket
+// upper bounds.
+func newHistogramVec(name, help string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+// Observe adds v to the histogram with the given labels.
+func (h *histogramVec) Observe(labels string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[labels]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[labels] = hist
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// snapshot returns the count and sum of the histogram by labels,
+// without the bucket counts.
+func (h *histogramVec) snapshot() map[string]histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	values := make(map[string]histogram, len(h.values))
+	for l, hist := range h.values {
+		values[l] = histogram{count: hist.count, sum: hist.sum}
+	}
+	return values
+}
+
+// write writes the histogram in the Prometheus text format.
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, l := range slices.Sorted(maps.Keys(h.values)) {
+		hist := h.values[l]
+		prefix := l
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", h.name, prefix, upper, hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", h.name, l, hist.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, l, hist.count)
+	}
+}
+
+// statusResponseWriter records the status code of the response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and writes it to the client.
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes b to the client.
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying http.ResponseWriter.
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingReader counts the bytes read from an io.ReadCloser.
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+// Read reads from the underlying reader and counts the bytes read.
+func (r countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes of the response body.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+// Write writes to the underlying writer and counts the bytes written.
+func (w countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+// Unwrap returns the underlying http.ResponseWriter.
+func (w countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
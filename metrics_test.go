@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerLabels(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q, "labels": {"zone": "eu-west-1a", "rack": "r\"1"}}],
+		"healthCheckInterval": "1h"
+	}`, backend.URL))
+	st := lb.State()
+	if n := st.healthChecker.UpdateAll(t.Context(), st.Servers); n != 1 {
+		t.Fatalf("%d healthy servers, want 1", n)
+	}
+	serve(lb, httptest.NewRequest("GET", "/", nil))
+
+	var b strings.Builder
+	writeMetrics(&b, lb)
+	want := fmt.Sprintf(`{server=%q,rack="r\"1",zone="eu-west-1a"}`, backend.URL)
+	for _, name := range []string{
+		"lb_server_healthy",
+		"lb_server_active_connections",
+		"lb_server_requests_total",
+		"lb_health_check_duration_seconds_count",
+	} {
+		if !strings.Contains(b.String(), name+want) {
+			t.Errorf("metrics have no %s%s:\n%s", name, want, b.String())
+		}
+	}
+}
+
+func TestReservedServerLabels(t *testing.T) {
+	for _, name := range []string{"server", "route", "code", "le", "__name", "0zone", "a-b"} {
+		_, err := newServer(ServerConfig{URL: "backend", Weight: 1, Labels: map[string]string{name: "x"}}, nil)
+		if err == nil {
+			t.Errorf("label %q accepted", name)
+		}
+	}
+	if _, err := newServer(ServerConfig{URL: "backend", Weight: 1, Labels: map[string]string{"zone": "x"}}, nil); err != nil {
+		t.Errorf("label zone rejected: %v", err)
+	}
+}
+
+func TestByteCounters(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(bytes.Repeat([]byte("x"), 3000))
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true
+	}`, backend.URL))
+	server := lb.State().Servers[0]
+
+	for range 2 {
+		w := serve(lb, httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("y", 1000))))
+		if w.Body.Len() != 3000 {
+			t.Fatalf("response has %d bytes, want 3000", w.Body.Len())
+		}
+	}
+	serve(lb, httptest.NewRequest("GET", "/", nil))
+
+	if got := server.RequestBytes.Load(); got != 2000 {
+		t.Errorf("%d request bytes counted, want 2000", got)
+	}
+	if got := server.ResponseBytes.Load(); got != 9000 {
+		t.Errorf("%d response bytes counted, want 9000", got)
+	}
+	var b strings.Builder
+	writeMetrics(&b, lb)
+	for _, want := range []string{
+		fmt.Sprintf("lb_server_request_bytes_total{server=%q} 2000\n", backend.URL),
+		fmt.Sprintf("lb_server_response_bytes_total{server=%q} 9000\n", backend.URL),
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics have no %s:\n%s", strings.TrimSpace(want), b.String())
+		}
+	}
+}
+
+func TestRouteMetrics(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"pools": {"api": {"servers": [{"url": %[1]q}]}},
+		"routes": [{"name": "api", "pathPrefix": "/api", "pool": "api"}, {"pathRegex": "\\.png$", "pool": "default"}],
+		"disableHealthChecks": true
+	}`, backend.URL))
+	for _, path := range []string{"/api/a", "/api/b", "/api/fail", "/logo.png", "/"} {
+		serve(lb, httptest.NewRequest("GET", path, nil))
+	}
+
+	requests := lb.Metrics.Requests.snapshot()
+	for _, tt := range []struct {
+		labels string
+		want   float64
+	}{
+		{labels("route", "api", "code", "200"), 2},
+		{labels("route", "api", "code", "502"), 1},
+		{labels("route", `\.png$`, "code", "200"), 1},
+		{labels("route", defaultPoolName, "code", "200"), 1},
+	} {
+		if got := requests[tt.labels]; got != tt.want {
+			t.Errorf("requests{%s} = %g, want %g", tt.labels, got, tt.want)
+		}
+	}
+	if len(requests) != 4 {
+		t.Errorf("requests have %d label sets, want 4: %v", len(requests), requests)
+	}
+
+	durations := lb.Metrics.RequestDuration.snapshot()
+	if got := durations[labels("route", "api")].count; got != 3 {
+		t.Errorf("request duration of route api observed %d times, want 3", got)
+	}
+	errors := lb.Metrics.RequestErrors.snapshot()
+	if got := errors[labels("route", "api")]; got != 1 {
+		t.Errorf("request errors of route api = %g, want 1", got)
+	}
+	if got := errors[labels("route", defaultPoolName)]; got != 0 {
+		t.Errorf("request errors of the default route = %g, want 0", got)
+	}
+}
+
+func TestHealthCheckMetrics(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	var failing atomic.Bool
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"healthCheckInterval": "1h"
+	}`, backend.URL))
+	st := lb.State()
+	st.healthChecker.UpdateAll(t.Context(), st.Servers)
+	failing.Store(true)
+	st.healthChecker.UpdateAll(t.Context(), st.Servers)
+
+	l := labels("server", backend.URL)
+	hist := lb.Metrics.HealthCheckDuration.snapshot()[l]
+	if hist.count != 2 || hist.sum < 2*delay.Seconds() {
+		t.Errorf("health check duration observed %d checks taking %gs, want 2 taking at least %gs", hist.count, hist.sum, 2*delay.Seconds())
+	}
+	if got := lb.Metrics.HealthCheckFailures.snapshot()[l]; got != 1 {
+		t.Errorf("health check failures = %g, want 1", got)
+	}
+
+	var b strings.Builder
+	writeMetrics(&b, lb)
+	for _, want := range []string{
+		fmt.Sprintf(`lb_health_check_duration_seconds_bucket{%s,le="0.025"} 0`, l),
+		fmt.Sprintf(`lb_health_check_duration_seconds_bucket{%s,le="10"} 2`, l),
+		fmt.Sprintf(`lb_health_check_failures_total{%s} 1`, l),
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("metrics have no %s:\n%s", want, b.String())
+		}
+	}
+}
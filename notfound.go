@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// NotFoundConfig represents the configuration of the response to the
+// requests matching no route or admin endpoint.
+type NotFoundConfig struct {
+	// Body of the response.
+	Body string `json:"body"`
+	// ContentType of the body, detected from it by default.
+	ContentType string `json:"contentType"`
+	// Status code of the response, defaults to 404.
+	Status int `json:"status"`
+}
+
+// newNotFound returns the response described by config, or nil if there
+// is none.
+func newNotFound(config *NotFoundConfig) (*staticResponse, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	status := config.Status
+	if status == 0 {
+		status = http.StatusNotFound
+	}
+	if status < 200 || status > 599 {
+		return nil, fmt.Errorf("parsing notFound.status: invalid status code %d", status)
+	}
+	body := []byte(config.Body)
+	contentType := config.ContentType
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return &staticResponse{status: status, contentType: contentType, body: body}, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotFound(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range []struct {
+		name, config      string
+		status            int
+		body, contentType string
+	}{
+		{"default", "", http.StatusNotFound, "404 page not found\n", "text/plain; charset=utf-8"},
+		{"custom", `"notFound": {"body": "{\"error\": \"not found\"}", "contentType": "application/json"},`,
+			http.StatusNotFound, `{"error": "not found"}`, "application/json"},
+		{"custom status", `"notFound": {"body": "<p>Gone</p>", "status": 410},`,
+			http.StatusGone, "<p>Gone</p>", "text/html; charset=utf-8"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}],
+				"routes": [{"pathPrefix": "/api", "pool": "default"}],
+				"defaultPool": "",
+				%s
+				"disableHealthChecks": true
+			}`, backend.URL, tt.config))
+			admin := newAdminHandler(&AdminConfig{}, lb)
+
+			for _, target := range []struct {
+				name string
+				h    http.Handler
+				path string
+			}{
+				{"unmatched request", lb, "/other"},
+				{"unknown admin path", admin, "/admin/unknown"},
+				{"admin root", admin, "/"},
+				{"request outside the base path", withBasePath("/lb", lb, lb.NotFound), "/api"},
+			} {
+				w := serve(target.h, httptest.NewRequest("GET", target.path, nil))
+				if w.Code != tt.status || w.Body.String() != tt.body || w.Header().Get("Content-Type") != tt.contentType {
+					t.Errorf("%s got %d %q of type %q, want %d %q of type %q", target.name, w.Code, w.Body, w.Header().Get("Content-Type"), tt.status, tt.body, tt.contentType)
+				}
+			}
+			if code := serve(lb, httptest.NewRequest("GET", "/api", nil)).Code; code != http.StatusOK {
+				t.Errorf("matched request got %d, want 200", code)
+			}
+		})
+	}
+
+	for _, status := range []int{99, 600} {
+		if _, err := newNotFound(&NotFoundConfig{Status: status}); err == nil {
+			t.Errorf("newNotFound with the status %d succeeded", status)
+		}
+	}
+}
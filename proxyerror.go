@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ProxyErrorConfig represents the configuration of the response to the
+// requests that could not be proxied to a server, e.g. because it was
+// unreachable or sent an invalid response.
+type ProxyErrorConfig struct {
+	// Body of the response, whose status code is 502, or 504 when the
+	// server timed out.
+	Body string `json:"body"`
+	// ContentType of the body, detected from it by default.
+	ContentType string `json:"contentType"`
+}
+
+// proxyErrorPage is the body of the responses to the requests that could
+// not be proxied.
+type proxyErrorPage struct {
+	contentType string
+	body        []byte
+}
+
+// newProxyErrorPage returns the page described by config, or nil if there
+// is none.
+func newProxyErrorPage(config *ProxyErrorConfig) *proxyErrorPage {
+	if config == nil {
+		return nil
+	}
+	body := []byte(config.Body)
+	contentType := config.ContentType
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return &proxyErrorPage{contentType: contentType, body: body}
+}
+
+// write writes the page to w with the given status code.
+func (p *proxyErrorPage) write(w http.ResponseWriter, r *http.Request, status int) {
+	w.Header().Set("Content-Type", p.contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(p.body)
+	}
+}
+
+// isInvalidResponseError reports whether err is the error of a server
+// that sent a malformed HTTP response.
+//
+// The errors of net/http are not typed, only their message tells.
+func isInvalidResponseError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "malformed HTTP") || strings.Contains(msg, "malformed MIME header")
+}
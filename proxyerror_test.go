@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// garbageBackend returns the URL of a backend answering every request
+// with response, closed at the end of the test.
+func garbageBackend(t *testing.T, response string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+					io.WriteString(conn, response)
+				}
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestInvalidResponse(t *testing.T) {
+	for _, tt := range []struct {
+		name, response string
+	}{
+		{"garbage", "garbage\r\n\r\n"},
+		{"malformed header", "HTTP/1.1 200 OK\r\nnot a header\r\n\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			garbage := garbageBackend(t, tt.response)
+			good := newBackend(t, func(w http.ResponseWriter, r *http.Request) {}).URL
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}, {"url": %q}],
+				"algorithm": "failover",
+				"errorWeightDecay": {"decay": 0.5, "recovery": 0.1},
+				"proxyError": {"body": "{\"error\": \"bad gateway\"}", "contentType": "application/json"},
+				"disableHealthChecks": true
+			}`, garbage, good))
+			st := lb.State()
+
+			w := serve(lb, httptest.NewRequest("GET", "/", nil))
+			if w.Code != http.StatusBadGateway || w.Body.String() != `{"error": "bad gateway"}` || w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("request to the invalid server got %d %q of type %q, want 502 with the proxy error page", w.Code, w.Body, w.Header().Get("Content-Type"))
+			}
+			if got := st.Servers[0].WeightFactor; got != 0.5 {
+				t.Errorf("weight factor of the invalid server = %g, want 0.5", got)
+			}
+			if got := st.Servers[1].WeightFactor; got != 1 {
+				t.Errorf("weight factor of the other server = %g, want 1", got)
+			}
+
+			logged := records(t, logs.String())
+			i := slices.IndexFunc(logged, func(r map[string]any) bool {
+				return r["msg"] == "Invalid response from server"
+			})
+			if i < 0 {
+				t.Fatalf("no invalid response logged:\n%s", logs)
+			}
+			if got := logged[i]["server"]; got != garbage {
+				t.Errorf("invalid response logged for the server %v, want %s", got, garbage)
+			}
+		})
+	}
+}
+
+func TestIsInvalidResponseError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf(`net/http: HTTP/1.x transport connection broken: malformed HTTP response "garbage"`), true},
+		{fmt.Errorf(`malformed MIME header line: not a header`), true},
+		{fmt.Errorf("dial tcp 127.0.0.1:1: connect: connection refused"), false},
+		{io.EOF, false},
+	} {
+		if got := isInvalidResponseError(tt.err); got != tt.want {
+			t.Errorf("isInvalidResponseError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// QueueConfig represents the configuration of the request queue.
+type QueueConfig struct {
+	// MaxInFlight is the maximum number of requests proxied concurrently.
+	MaxInFlight int `json:"maxInFlight"`
+	// Size is the maximum number of requests waiting for one of the
+	// in-flight requests to complete. Requests are rejected beyond it.
+	Size int `json:"size"`
+	// Timeout is the maximum duration a request waits in the queue. Zero
+	// waits until the client gives up.
+	Timeout Duration `json:"timeout"`
+}
+
+var (
+	// errQueueFull is returned when the queue has no room for a request.
+	errQueueFull = errors.New("request queue is full")
+	// errQueueTimeout is returned when a request waited too long.
+	errQueueTimeout = errors.New("request queue timeout")
+)
+
+// requestQueue limits the number of requests proxied concurrently,
+// queueing the others.
+type requestQueue struct {
+	slots   chan struct{}
+	size    int64
+	timeout time.Duration
+	waiting atomic.Int64
+}
+
+// newRequestQueue returns the queue described by config.
+func newRequestQueue(config *QueueConfig) (*requestQueue, error) {
+	if config.MaxInFlight <= 0 {
+		return nil, fmt.Errorf("maxInFlight must be greater than 0")
+	}
+	if config.Size < 0 {
+		return nil, fmt.Errorf("size must not be negative")
+	}
+	timeout := time.Duration(config.Timeout)
+	if timeout < 0 {
+		return nil, fmt.Errorf("timeout must not be negative")
+	}
+
+	return &requestQueue{
+		slots:   make(chan struct{}, config.MaxInFlight),
+		size:    int64(config.Size),
+		timeout: timeout,
+	}, nil
+}
+
+// Acquire waits until the request can be proxied and returns how long it
+// waited. Release must be called once the request completes, unless an
+// error is returned.
+func (q *requestQueue) Acquire(ctx context.Context) (time.Duration, error) {
+	select {
+	case q.slots <- struct{}{}:
+		return 0, nil
+	default:
+	}
+
+	if q.waiting.Add(1) > q.size {
+		q.waiting.Add(-1)
+		return 0, errQueueFull
+	}
+	defer q.waiting.Add(-1)
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if q.timeout > 0 {
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+		return time.Since(start), nil
+	case <-timeout:
+		return time.Since(start), errQueueTimeout
+	case <-ctx.Done():
+		return time.Since(start), ctx.Err()
+	}
+}
+
+// Release releases the slot of a completed request.
+func (q *requestQueue) Release() {
+	<-q.slots
+}
+
+// Depth returns the number of requests waiting in the queue.
+func (q *requestQueue) Depth() int64 {
+	return q.waiting.Load()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestQueueNoTimeoutWaits(t *testing.T) {
+	q, err := newRequestQueue(&QueueConfig{MaxInFlight: 1, Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := q.Acquire(context.Background())
+		acquired <- err
+	}()
+
+	select {
+	case err := <-acquired:
+		t.Fatalf("Acquire returned %v while the slot is taken", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("Acquire returned %v after Release", err)
+	}
+}
+
+func TestRequestQueueNoTimeoutCanceled(t *testing.T) {
+	q, err := newRequestQueue(&QueueConfig{MaxInFlight: 1, Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Acquire returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestQueueSaturated(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"queue": {"maxInFlight": 1, "size": 1, "timeout": "5s"}
+	}`, backend.URL))
+
+	codes := make(chan int, 2)
+	for range 2 {
+		go func() {
+			codes <- serve(lb, httptest.NewRequest("GET", "/", nil)).Code
+		}()
+	}
+	<-started
+	for lb.State().Queue.Depth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full: one request in flight, one waiting.
+	if code := serve(lb, httptest.NewRequest("GET", "/", nil)).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("request beyond the queue got %d, want 503", code)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for range 2 {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("queued request got %d, want 200", code)
+		}
+	}
+
+	wait := lb.Metrics.QueueWait.snapshot()[""]
+	if wait.count != 3 {
+		t.Errorf("queue wait observed %d times, want 3", wait.count)
+	}
+	if wait.sum < 0.02 {
+		t.Errorf("queue wait sum is %gs, want at least 0.02s", wait.sum)
+	}
+}
+
+func TestServerQueue(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		size int
+		want int
+	}{
+		{"rejected", 0, http.StatusServiceUnavailable},
+		{"waits", 1, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				<-release
+			})
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q, "queue": {"maxInFlight": 2, "size": %d}}],
+				"disableHealthChecks": true
+			}`, backend.URL, tt.size))
+			server := lb.State().Servers[0]
+
+			codes := make(chan int, 3)
+			for range 2 {
+				go func() {
+					codes <- serve(lb, httptest.NewRequest("GET", "/", nil)).Code
+				}()
+			}
+			for active(server) != 2 {
+				time.Sleep(time.Millisecond)
+			}
+
+			// The N+1th request.
+			go func() {
+				codes <- serve(lb, httptest.NewRequest("GET", "/", nil)).Code
+			}()
+			if tt.size > 0 {
+				for server.Queue.Depth() != 1 {
+					time.Sleep(time.Millisecond)
+				}
+				close(release)
+			} else {
+				if code := <-codes; code != tt.want {
+					t.Errorf("N+1th request got %d, want %d", code, tt.want)
+				}
+				close(release)
+			}
+
+			for range 2 {
+				if code := <-codes; code != http.StatusOK {
+					t.Errorf("request got %d, want 200", code)
+				}
+			}
+			if tt.size > 0 {
+				if code := <-codes; code != tt.want {
+					t.Errorf("N+1th request got %d, want %d", code, tt.want)
+				}
+			}
+			if got := server.Requests.Load(); got != int64(2+tt.size) {
+				t.Errorf("server got %d requests, want %d", got, 2+tt.size)
+			}
+		})
+	}
+}
+
+// active returns the number of requests proxied to s.
+func active(s *Server) int {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	return s.ActiveConnections
+}
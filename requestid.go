@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// maxRequestIDLength is the length above which the request IDs of the
+// clients are replaced.
+const maxRequestIDLength = 128
+
+// requestID returns the ID of r in its header, or a new one if it has
+// none or an invalid one, and sets it in the header of r and w so that it
+// is sent to the server and echoed to the client.
+func requestID(w http.ResponseWriter, r *http.Request, header string) string {
+	id := r.Header.Get(header)
+	if !isValidRequestID(id) {
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	r.Header.Set(header, id)
+	w.Header().Set(header, id)
+	return id
+}
+
+// isValidRequestID reports whether id is a non-empty string of visible
+// ASCII characters at most maxRequestIDLength long.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := range len(id) {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	const header = "X-Correlation-ID"
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Join(r.Header.Values(header), ","))
+	})
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+	for _, tt := range []struct {
+		name, id string
+		// kept is true if the ID of the client is kept.
+		kept bool
+	}{
+		{"generated", "", false},
+		{"incoming", "client-id-42", true},
+		{"invalid", "two words", false},
+		{"too long", strings.Repeat("x", maxRequestIDLength+1), false},
+		{"longest", strings.Repeat("x", maxRequestIDLength), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}],
+				"requestIDHeader": %q,
+				"accessLog": true,
+				"disableHealthChecks": true
+			}`, backend.URL, header))
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.id != "" {
+				r.Header.Set(header, tt.id)
+			}
+			w := serve(lb, r)
+
+			id := w.Header().Get(header)
+			if tt.kept && id != tt.id || !tt.kept && !generated.MatchString(id) {
+				t.Errorf("response has the ID %q, want the one of the client kept %v", id, tt.kept)
+			}
+			if got := w.Body.String(); got != id {
+				t.Errorf("server got the ID %q, want %q", got, id)
+			}
+			logged := 0
+			for _, record := range records(t, logs.String()) {
+				if record["msg"] == "Request" {
+					logged++
+					if record["requestID"] != id {
+						t.Errorf("request logged with the ID %v, want %q", record["requestID"], id)
+					}
+				}
+			}
+			if logged != 1 {
+				t.Errorf("%d requests logged, want 1", logged)
+			}
+		})
+	}
+
+	// Each request gets its own ID.
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"requestIDHeader": %q,
+		"disableHealthChecks": true
+	}`, backend.URL, header))
+	first := serve(lb, httptest.NewRequest("GET", "/", nil)).Header().Get(header)
+	if second := serve(lb, httptest.NewRequest("GET", "/", nil)).Header().Get(header); second == first {
+		t.Errorf("two requests got the same ID %q", first)
+	}
+}
+
+func TestRequestIDDisabled(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Request-ID"))
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true
+	}`, backend.URL))
+	w := serve(lb, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("X-Request-ID") != "" || w.Body.Len() != 0 {
+		t.Errorf("request without requestIDHeader got the ID %q, sent %q, want none", w.Header().Get("X-Request-ID"), w.Body)
+	}
+
+	for _, header := range []string{"X Request", "X-Request-ID:"} {
+		c, err := loadConfig(writeConfig(t, fmt.Sprintf(`{
+			"servers": ["backend"],
+			"requestIDHeader": %q,
+			"disableHealthChecks": true
+		}`, header)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newState(c); err == nil {
+			t.Errorf("requestIDHeader %q accepted", header)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// requestLimits restricts the requests proxied to the servers.
+type requestLimits struct {
+	// methods is nil when all methods are allowed.
+	methods map[string]bool
+	// allow is the Allow header of the 405 responses.
+	allow          string
+	maxHeaders     int
+	maxHeaderBytes int
+}
+
+// newRequestLimits returns the limits set by config, or nil if there are
+// none.
+func newRequestLimits(config Config) (*requestLimits, error) {
+	if config.MaxRequestHeaders < 0 {
+		return nil, fmt.Errorf("parsing maxRequestHeaders: must not be negative")
+	}
+	if config.MaxRequestHeaderBytes < 0 {
+		return nil, fmt.Errorf("parsing maxRequestHeaderBytes: must not be negative")
+	}
+	if len(config.AllowedMethods) == 0 && config.MaxRequestHeaders == 0 && config.MaxRequestHeaderBytes == 0 {
+		return nil, nil
+	}
+
+	l := &requestLimits{maxHeaders: config.MaxRequestHeaders, maxHeaderBytes: config.MaxRequestHeaderBytes}
+	if len(config.AllowedMethods) > 0 {
+		l.methods = map[string]bool{}
+		var allow []string
+		for _, method := range config.AllowedMethods {
+			if method == "" || strings.ContainsAny(method, " \t\r\n,") {
+				return nil, fmt.Errorf("parsing allowedMethods: invalid method %q", method)
+			}
+			method = strings.ToUpper(method)
+			if !l.methods[method] {
+				l.methods[method] = true
+				allow = append(allow, method)
+			}
+		}
+		l.allow = strings.Join(allow, ", ")
+	}
+	return l, nil
+}
+
+// check answers r and returns false if it exceeds the limits.
+//
+// The headers are counted as received from the client, each value of a
+// header being a field, and their size as in HTTP/1.1, "Name: value\r\n".
+func (l *requestLimits) check(w http.ResponseWriter, r *http.Request) bool {
+	if l.methods != nil && !l.methods[r.Method] {
+		w.Header().Set("Allow", l.allow)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	fields, size := 0, 0
+	for name, values := range r.Header {
+		fields += len(values)
+		for _, v := range values {
+			size += len(name) + len(v) + len(": \r\n")
+		}
+	}
+	if (l.maxHeaders > 0 && fields > l.maxHeaders) || (l.maxHeaderBytes > 0 && size > l.maxHeaderBytes) {
+		http.Error(w, "Request Header Fields Too Large", http.StatusRequestHeaderFieldsTooLarge)
+		return false
+	}
+	return true
+}
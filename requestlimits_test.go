@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRequestLimits(t *testing.T) {
+	var requests atomic.Int64
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) { requests.Add(1) })
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"allowedMethods": ["get", "POST", "GET"],
+		"maxRequestHeaders": 3,
+		"maxRequestHeaderBytes": 1024,
+		"disableHealthChecks": true
+	}`, backend.URL))
+
+	for _, tt := range []struct {
+		name, method string
+		header       http.Header
+		want         int
+	}{
+		{"allowed", "GET", http.Header{"Accept": {"*/*"}}, http.StatusOK},
+		{"allowed POST", "POST", nil, http.StatusOK},
+		{"TRACE", "TRACE", nil, http.StatusMethodNotAllowed},
+		{"CONNECT", "CONNECT", nil, http.StatusMethodNotAllowed},
+		{"lowercase", "get", nil, http.StatusMethodNotAllowed},
+		{"maximum headers", "GET", http.Header{"A": {"1", "2"}, "B": {"3"}}, http.StatusOK},
+		{"too many headers", "GET", http.Header{"A": {"1", "2"}, "B": {"3"}, "C": {"4"}}, http.StatusRequestHeaderFieldsTooLarge},
+		{"header too large", "GET", http.Header{"Cookie": {strings.Repeat("x", 16<<10)}}, http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			before := requests.Load()
+			r := httptest.NewRequest(tt.method, "/", nil)
+			r.Header = tt.header
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+			w := serve(lb, r)
+			if w.Code != tt.want {
+				t.Errorf("%s request got %d, want %d", tt.method, w.Code, tt.want)
+			}
+			proxied := requests.Load() - before
+			if tt.want == http.StatusOK && proxied != 1 || tt.want != http.StatusOK && proxied != 0 {
+				t.Errorf("%s request proxied %d times, want it proxied only if allowed", tt.method, proxied)
+			}
+			if tt.want == http.StatusMethodNotAllowed {
+				if got := w.Header().Get("Allow"); got != "GET, POST" {
+					t.Errorf("Allow = %q, want GET, POST", got)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRequestLimits(t *testing.T) {
+	if l, err := newRequestLimits(Config{}); l != nil || err != nil {
+		t.Errorf("newRequestLimits without limits = %v, %v, want none", l, err)
+	}
+	for _, config := range []Config{
+		{MaxRequestHeaders: -1},
+		{MaxRequestHeaderBytes: -1},
+		{AllowedMethods: []string{""}},
+		{AllowedMethods: []string{"GET, POST"}},
+	} {
+		if _, err := newRequestLimits(config); err == nil {
+			t.Errorf("newRequestLimits with methods %q, %d headers and %d header bytes succeeded", config.AllowedMethods, config.MaxRequestHeaders, config.MaxRequestHeaderBytes)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// errSlowResponse cancels the requests whose response is streamed too
+// slowly.
+var errSlowResponse = errors.New("response streamed below minResponseRate")
+
+// MinResponseRateConfig represents the configuration of the minimum rate
+// at which the servers must stream their response bodies.
+type MinResponseRateConfig struct {
+	// BytesPerSecond is the minimum average rate over Window.
+	BytesPerSecond int64 `json:"bytesPerSecond"`
+	// Window over which the rate is measured, defaults to 10s.
+	Window Duration `json:"window"`
+}
+
+// responseRate aborts the responses streamed too slowly.
+type responseRate struct {
+	// min is the minimum number of bytes read per window.
+	min    int64
+	window time.Duration
+}
+
+// newResponseRate returns the minimum response rate described by config,
+// or nil if there is none.
+func newResponseRate(config *MinResponseRateConfig) (*responseRate, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if config.BytesPerSecond <= 0 {
+		return nil, fmt.Errorf("parsing minResponseRate.bytesPerSecond: must be greater than 0")
+	}
+	window := time.Duration(config.Window)
+	if window == 0 {
+		window = 10 * time.Second
+	}
+	if window < time.Second {
+		return nil, fmt.Errorf("parsing minResponseRate.window: must be at least 1s")
+	}
+	return &responseRate{min: config.BytesPerSecond * int64(window/time.Second), window: window}, nil
+}
+
+// watch returns body, calling cancel with errSlowResponse if less than
+// the minimum is read from it in a window.
+//
+// Only the time spent waiting for the server in Read counts towards the
+// windows, so that a client reading slowly does not abort the response.
+func (rr *responseRate) watch(body io.ReadCloser, cancel context.CancelCauseFunc) io.ReadCloser {
+	b := &watchedBody{ReadCloser: body, done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(rr.window / 10)
+		defer ticker.Stop()
+
+		var last int64
+		var lastWaited time.Duration
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-ticker.C:
+			}
+			n, waited := b.progress(time.Now())
+			if waited-lastWaited < rr.window {
+				continue
+			}
+			if float64(n-last) < float64(rr.min)*float64(waited-lastWaited)/float64(rr.window) {
+				cancel(errSlowResponse)
+				return
+			}
+			last, lastWaited = n, waited
+		}
+	}()
+	return b
+}
+
+// watchedBody counts the bytes read from a response body, and the time
+// spent reading them, until it is closed.
+type watchedBody struct {
+	io.ReadCloser
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex
+	n  int64
+	// waited is the time spent in the completed reads.
+	waited time.Duration
+	// readStart is the start of the current read, zero if there is none.
+	readStart time.Time
+}
+
+// Read reads from the body and counts the bytes read.
+func (b *watchedBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	b.readStart = time.Now()
+	b.mu.Unlock()
+
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	b.n += int64(n)
+	b.waited += time.Since(b.readStart)
+	b.readStart = time.Time{}
+	b.mu.Unlock()
+	return n, err
+}
+
+// progress returns the number of bytes read and the time spent reading
+// them at now.
+func (b *watchedBody) progress(now time.Time) (int64, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	waited := b.waited
+	if !b.readStart.IsZero() {
+		waited += now.Sub(b.readStart)
+	}
+	return b.n, waited
+}
+
+// Close stops watching the body and closes it.
+func (b *watchedBody) Close() error {
+	b.closeOnce.Do(func() { close(b.done) })
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMinResponseRateTrickle(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		for range 100 {
+			if _, err := w.Write([]byte("0123456789")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"minResponseRate": {"bytesPerSecond": 1000, "window": "1s"}
+	}`, backend.URL))
+
+	start := time.Now()
+	w := serve(lb, httptest.NewRequest("GET", "/", nil))
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("trickling response took %s, want it aborted after the window", d)
+	}
+	if n := w.Body.Len(); n >= 1000 {
+		t.Errorf("trickling response has %d bytes, want it aborted", n)
+	}
+}
+
+func TestMinResponseRateSlowClient(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 32<<20)
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"minResponseRate": {"bytesPerSecond": 1000000, "window": "1s"}
+	}`, backend.URL))
+	front := httptest.NewServer(lb)
+	defer front.Close()
+
+	res, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	// The proxy blocks writing to the client, not reading from the
+	// server, for more than a full window.
+	if _, err := io.ReadFull(res.Body, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2500 * time.Millisecond)
+	n, err := io.Copy(io.Discard, res.Body)
+	if err != nil || n+1024 != int64(len(body)) {
+		t.Errorf("slow client read %d bytes, %v, want %d", n+1024, err, len(body))
+	}
+}
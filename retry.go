@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// idempotentMethods contains the methods of requests that are always
+// retryable.
+var idempotentMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// idempotencyKeyHeader is the header making a request retryable if
+// retryIdempotencyKey is enabled.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// retryPolicy decides which requests can be retried.
+type retryPolicy struct {
+	// methods contains the retryable methods.
+	methods map[string]bool
+	// idempotencyKey makes requests with an Idempotency-Key header retryable.
+	idempotencyKey bool
+	// backoff is the maximum duration waited before a retry.
+	backoff time.Duration
+	// statuses contains the retried status codes.
+	statuses map[int]bool
+}
+
+// statusError is the error of an attempt answered with a retried status code.
+type statusError struct {
+	status int
+}
+
+// Error returns the description of the error.
+func (e statusError) Error() string {
+	return fmt.Sprintf("server answered with status code %d", e.status)
+}
+
+// newRetryPolicy returns a policy retrying the idempotent methods and
+// the extra methods, on errors and the given status codes.
+func newRetryPolicy(extra []string, idempotencyKey bool, statuses []int) (retryPolicy, error) {
+	p := retryPolicy{methods: map[string]bool{}, idempotencyKey: idempotencyKey, statuses: map[int]bool{}}
+	for _, status := range statuses {
+		if status < 400 || status > 599 {
+			return p, fmt.Errorf("parsing retryOnStatus: invalid status code %d", status)
+		}
+		p.statuses[status] = true
+	}
+	for _, method := range idempotentMethods {
+		p.methods[method] = true
+	}
+	for _, method := range extra {
+		if method == "" || strings.ContainsAny(method, " \t\r\n") {
+			return p, fmt.Errorf("parsing retryMethods: invalid method %q", method)
+		}
+		p.methods[strings.ToUpper(method)] = true
+	}
+	return p, nil
+}
+
+// allows reports whether r can be sent again after a failure.
+//
+// The body of r, if any, must be buffered with bufferBody to be sent again.
+func (p retryPolicy) allows(r *http.Request) bool {
+	return p.methods[r.Method] || (p.idempotencyKey && r.Header.Get(idempotencyKeyHeader) != "")
+}
+
+// wait waits before retrying a request that failed with err. It returns
+// an error if the context of the request ends first, err if it would end
+// while waiting.
+func (p retryPolicy) wait(ctx context.Context, err error) error {
+	if p.backoff <= 0 {
+		return nil
+	}
+
+	// Jitter spreads the retries of concurrent requests.
+	delay := p.backoff/2 + rand.N(p.backoff/2+1)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return err
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hasBody reports whether r has a body.
+func hasBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody
+}
+
+// bufferBody reads the body of r if it is at most maxBytes long, so
+// that it can be sent again, and reports whether it did.
+//
+// Longer bodies are left readable as received.
+func bufferBody(r *http.Request, maxBytes int64) ([]byte, bool, error) {
+	if maxBytes <= 0 || r.ContentLength > maxBytes {
+		return nil, false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > maxBytes {
+		r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+// readCloser combines a reader with the closer of another reader.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// isRetryableError reports whether a request failing with err may
+// succeed on another attempt.
+//
+// Timeouts and canceled requests are not retried since the request
+// context is shared by all attempts.
+func isRetryableError(err error) bool {
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// writeProxyError answers a request that could not be proxied to a
+// server, with the proxy error page if any.
+func (st *State) writeProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	var statusErr statusError
+	switch {
+	case errors.As(err, &statusErr):
+		status = statusErr.status
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	}
+	if st.proxyErrorPage != nil {
+		st.proxyErrorPage.write(w, r, status)
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
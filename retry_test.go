@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closingBackend returns the URL of a backend writing partial to the
+// connection then closing it, and the number of requests it got.
+func closingBackend(t *testing.T, partial string) (string, *atomic.Int64) {
+	t.Helper()
+	var requests atomic.Int64
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		buf.WriteString(partial)
+		buf.Flush()
+		conn.Close()
+	})
+	return backend.URL, &requests
+}
+
+func TestBackendClosesConnection(t *testing.T) {
+	for _, tt := range []struct {
+		name, partial string
+	}{
+		{"no response", ""},
+		{"partial header", "HTTP/1.1 200 OK\r\nContent-Le"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backendURL, requests := closingBackend(t, tt.partial)
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}],
+				"disableHealthChecks": true
+			}`, backendURL))
+			server := lb.State().Servers[0]
+
+			for range 3 {
+				if code := serve(lb, httptest.NewRequest("GET", "/", nil)).Code; code != http.StatusBadGateway {
+					t.Errorf("request got %d, want 502", code)
+				}
+			}
+			if got := active(server); got != 0 {
+				t.Errorf("%d active connections after the requests, want 0", got)
+			}
+			if got := server.Requests.Load(); got != 3 || requests.Load() != 3 {
+				t.Errorf("%d requests counted and %d received, want 3", got, requests.Load())
+			}
+		})
+	}
+}
+
+func TestBackendClosesConnectionMidBody(t *testing.T) {
+	backendURL, _ := closingBackend(t, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial")
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true
+	}`, backendURL))
+	frontend := httptest.NewServer(lb)
+	t.Cleanup(frontend.Close)
+
+	// The response is aborted, the client must not take it as complete.
+	res, err := http.Get(frontend.URL)
+	if err == nil {
+		_, err = io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	if err == nil {
+		t.Error("truncated response read without error")
+	}
+	if got := active(lb.State().Servers[0]); got != 0 {
+		t.Errorf("%d active connections after the request, want 0", got)
+	}
+}
+
+func TestBackendClosesConnectionRetried(t *testing.T) {
+	backendURL, requests := closingBackend(t, "")
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}, {"url": %q}],
+		"algorithm": "failover",
+		"maxRetries": 1,
+		"disableHealthChecks": true
+	}`, backendURL, backend.URL))
+	st := lb.State()
+
+	if code := serve(lb, httptest.NewRequest("GET", "/", nil)).Code; code != http.StatusOK {
+		t.Errorf("retried request got %d, want 200", code)
+	}
+	if requests.Load() != 1 || st.Servers[1].Requests.Load() != 1 {
+		t.Errorf("servers got %d and %d requests, want 1 each", requests.Load(), st.Servers[1].Requests.Load())
+	}
+	for _, server := range st.Servers {
+		if got := active(server); got != 0 {
+			t.Errorf("%d active connections to %s after the request, want 0", got, server.URL)
+		}
+	}
+}
+
+func TestRetryMethods(t *testing.T) {
+	for _, tt := range []struct {
+		name, config, method string
+		idempotencyKey       bool
+		retried              bool
+	}{
+		{"GET", "", "GET", false, true},
+		{"POST", "", "POST", false, false},
+		{"POST with an idempotency key not honored", "", "POST", true, false},
+		{"POST configured", `"retryMethods": ["post"],`, "POST", false, true},
+		{"PUT not configured", `"retryMethods": ["POST"],`, "PUT", false, false},
+		{"POST with an idempotency key", `"retryIdempotencyKey": true,`, "POST", true, true},
+		{"POST without an idempotency key", `"retryIdempotencyKey": true,`, "POST", false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backendURL, _ := closingBackend(t, "")
+			var body string
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				body = string(b)
+			})
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}, {"url": %q}],
+				"algorithm": "failover",
+				"maxRetries": 1,
+				"maxRetryBodyBytes": 1024,
+				%s
+				"disableHealthChecks": true
+			}`, backendURL, backend.URL, tt.config))
+
+			var r *http.Request
+			if tt.method == "GET" {
+				r = httptest.NewRequest(tt.method, "/", nil)
+			} else {
+				r = httptest.NewRequest(tt.method, "/", strings.NewReader("payload"))
+			}
+			if tt.idempotencyKey {
+				r.Header.Set(idempotencyKeyHeader, "key-1")
+			}
+			code := serve(lb, r).Code
+
+			if retried := code == http.StatusOK; retried != tt.retried {
+				t.Fatalf("request got %d, retried %v, want %v", code, retried, tt.retried)
+			}
+			if tt.retried && tt.method != "GET" && body != "payload" {
+				t.Errorf("retried request had body %q, want %q", body, "payload")
+			}
+		})
+	}
+}
+
+func TestRetryBodyTooLarge(t *testing.T) {
+	backendURL, requests := closingBackend(t, "")
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}, {"url": %q}],
+		"algorithm": "failover",
+		"maxRetries": 1,
+		"maxRetryBodyBytes": 4,
+		"retryMethods": ["POST"],
+		"disableHealthChecks": true
+	}`, backendURL, backend.URL))
+
+	if code := serve(lb, httptest.NewRequest("POST", "/", strings.NewReader("payload"))).Code; code != http.StatusBadGateway {
+		t.Errorf("request with a body too large to retry got %d, want 502", code)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("failing server got %d requests, want 1", requests.Load())
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		body          string
+		contentLength int64
+		maxBytes      int64
+		buffered      bool
+	}{
+		{"small", "payload", 7, 16, true},
+		{"at the limit", "payload", 7, 7, true},
+		{"unknown length", "payload", -1, 16, true},
+		{"too large", "payload", 7, 4, false},
+		{"too large with unknown length", "payload", -1, 4, false},
+		{"disabled", "payload", 7, 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			r.ContentLength = tt.contentLength
+			body, buffered, err := bufferBody(r, tt.maxBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buffered != tt.buffered {
+				t.Fatalf("bufferBody buffered %v, want %v", buffered, tt.buffered)
+			}
+			if buffered {
+				if string(body) != tt.body {
+					t.Errorf("buffered body %q, want %q", body, tt.body)
+				}
+				return
+			}
+			// The body is left readable as received.
+			rest, err := io.ReadAll(r.Body)
+			if err != nil || string(rest) != tt.body {
+				t.Errorf("body after bufferBody %q, %v, want %q", rest, err, tt.body)
+			}
+		})
+	}
+}
+
+func TestBufferBodyProxied(t *testing.T) {
+	var got []string
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = append(got, string(b))
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"maxRetries": 1,
+		"maxRetryBodyBytes": 1024,
+		"retryMethods": ["POST"],
+		"disableHealthChecks": true
+	}`, backend.URL))
+
+	for _, body := range []string{"small", strings.Repeat("x", 4096)} {
+		got = nil
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		// Also when the length is unknown, e.g. chunked.
+		r.ContentLength = -1
+		if code := serve(lb, r).Code; code != http.StatusOK {
+			t.Errorf("request with a %d byte body got %d, want 200", len(body), code)
+		}
+		if len(got) != 1 || got[0] != body {
+			t.Errorf("backend got %d requests, want 1 with the %d byte body", len(got), len(body))
+		}
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	attemptErr := errors.New("connection refused")
+
+	if err := (retryPolicy{}).wait(t.Context(), attemptErr); err != nil {
+		t.Errorf("wait without backoff = %v, want nil", err)
+	}
+
+	p := retryPolicy{backoff: 100 * time.Millisecond}
+	for range 5 {
+		start := time.Now()
+		if err := p.wait(t.Context(), attemptErr); err != nil {
+			t.Fatalf("wait = %v, want nil", err)
+		}
+		if d := time.Since(start); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Errorf("waited %s, want between half the backoff and the backoff", d)
+		}
+	}
+
+	// The request would time out while waiting.
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.wait(ctx, attemptErr); err != attemptErr {
+		t.Errorf("wait past the deadline = %v, want %v", err, attemptErr)
+	}
+	if d := time.Since(start); d > 5*time.Millisecond {
+		t.Errorf("wait past the deadline took %s, want returning at once", d)
+	}
+
+	ctx, cancel = context.WithCancel(t.Context())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := p.wait(ctx, attemptErr); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait canceled = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	backendURL, requests := closingBackend(t, "")
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"maxRetries": 2,
+		"retryBackoff": "40ms",
+		"disableHealthChecks": true
+	}`, backendURL))
+
+	start := time.Now()
+	if code := serve(lb, httptest.NewRequest("GET", "/", nil)).Code; code != http.StatusBadGateway {
+		t.Errorf("request failing every attempt got %d, want 502", code)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("3 attempts took %s, want at least 2 waits of 20ms", d)
+	}
+	if requests.Load() != 3 {
+		t.Errorf("server got %d attempts, want 3", requests.Load())
+	}
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	for _, tt := range []struct {
+		status  int
+		retried bool
+	}{
+		{http.StatusServiceUnavailable, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusNotFound, false},
+		{http.StatusOK, false},
+	} {
+		t.Run(fmt.Sprint(tt.status), func(t *testing.T) {
+			logs := captureLogs(t)
+			first := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, "first")
+			})
+			second := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "second")
+			})
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}, {"url": %q}],
+				"algorithm": "failover",
+				"maxRetries": 1,
+				"retryOnStatus": [502, 503],
+				"disableHealthChecks": true
+			}`, first.URL, second.URL))
+
+			w := serve(lb, httptest.NewRequest("GET", "/", nil))
+			want, wantBody := tt.status, "first"
+			if tt.retried {
+				want, wantBody = http.StatusOK, "second"
+			}
+			if w.Code != want || w.Body.String() != wantBody {
+				t.Errorf("first server answering %d: got %d %q, want %d %q", tt.status, w.Code, w.Body, want, wantBody)
+			}
+
+			// Retried statuses are not logged as errors.
+			retries := 0
+			for _, r := range records(t, logs.String()) {
+				if r["level"] == "ERROR" && r["server"] == first.URL {
+					t.Errorf("error logged: %v", r)
+				}
+				if r["msg"] == "Retrying status" {
+					retries++
+					if r["level"] != "WARN" || r["status"] != float64(tt.status) || r["server"] != first.URL {
+						t.Errorf("retry logged as %v, want a warning of the status %d of %s", r, tt.status, first.URL)
+					}
+				}
+			}
+			wantRetries := 0
+			if tt.retried {
+				wantRetries = 1
+			}
+			if retries != wantRetries {
+				t.Errorf("%d retries logged, want %d", retries, wantRetries)
+			}
+		})
+	}
+}
+
+func TestRetryOnStatusLastAttempt(t *testing.T) {
+	var requests atomic.Int64
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "overloaded")
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"maxRetries": 2,
+		"retryOnStatus": [503],
+		"disableHealthChecks": true
+	}`, backend.URL))
+
+	// The response of the last attempt is sent as is.
+	w := serve(lb, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "overloaded" {
+		t.Errorf("request answered 503 on every attempt got %d %q, want 503 %q", w.Code, w.Body, "overloaded")
+	}
+	if requests.Load() != 3 {
+		t.Errorf("server got %d attempts, want 3", requests.Load())
+	}
+
+	for _, status := range []int{200, 399, 600} {
+		if _, err := newRetryPolicy(nil, false, []int{status}); err == nil {
+			t.Errorf("newRetryPolicy with the status %d succeeded", status)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxRewriteBodyBytes is the largest response body that is rewritten,
+// unless Config.MaxBufferBytes is set. Larger bodies are passed through
+// unchanged.
+const maxRewriteBodyBytes = 10 << 20
+
+// RewriteConfig represents a find and replace rule applied to the
+// bodies of responses with the given content type.
+type RewriteConfig struct {
+	// ContentType of the rewritten responses, e.g. "text/html".
+	ContentType string `json:"contentType"`
+	// Find is the string to replace.
+	Find string `json:"find"`
+	// Replace is the replacement string.
+	Replace string `json:"replace"`
+}
+
+// validateRewrites checks that the rewrite rules can be applied.
+func validateRewrites(rules []RewriteConfig) error {
+	for i, rule := range rules {
+		if rule.Find == "" {
+			return fmt.Errorf("parsing responseRewrites: rule %d needs find", i)
+		}
+		if !isTextContentType(rule.ContentType) {
+			return fmt.Errorf("parsing responseRewrites: rule %d: %q is not a text content type", i, rule.ContentType)
+		}
+	}
+	return nil
+}
+
+// isTextContentType reports whether mediaType is a textual media type.
+func isTextContentType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") ||
+		mediaType == "application/json" ||
+		mediaType == "application/javascript" ||
+		mediaType == "application/xml"
+}
+
+// rewriteBody applies the rules matching the content type of res to its body.
+//
+// Encoded bodies and bodies larger than maxBytes are left untouched, as well as streamed
+// bodies, of unknown length or followed by trailers, so that they are
+// not buffered, unless decompressed by the transport. Gzip-encoded bodies
+// are decompressed to be rewritten if decodeGzip is true.
+func rewriteBody(res *http.Response, rules []RewriteConfig, decodeGzip bool, maxBytes int64) error {
+	if len(rules) == 0 || res.Request.Method == http.MethodHead ||
+		res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	gzipped := false
+	if enc := res.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		if !decodeGzip || enc != "gzip" {
+			return nil
+		}
+		gzipped = true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+
+	var matching []RewriteConfig
+	for _, rule := range rules {
+		if rule.ContentType == mediaType {
+			matching = append(matching, rule)
+		}
+	}
+	// Bodies decompressed by the transport have an unknown length.
+	if len(matching) == 0 || (res.ContentLength < 0 && !res.Uncompressed) ||
+		res.ContentLength > maxBytes || len(res.Trailer) > 0 {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > maxBytes {
+		res.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), res.Body), Closer: res.Body}
+		return nil
+	}
+	if err := res.Body.Close(); err != nil {
+		return err
+	}
+	if gzipped {
+		decoded, ok := gunzip(body, maxBytes)
+		if !ok {
+			res.Body = io.NopCloser(bytes.NewReader(body))
+			return nil
+		}
+		body = decoded
+	}
+
+	for _, rule := range matching {
+		body = bytes.ReplaceAll(body, []byte(rule.Find), []byte(rule.Replace))
+	}
+
+	if gzipped {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// gunzip decompresses the gzip data b and reports whether it is valid and
+// at most maxBytes long once decompressed.
+func gunzip(b []byte, maxBytes int64) ([]byte, bool) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, false
+	}
+	decoded, err := io.ReadAll(io.LimitReader(zr, maxBytes+1))
+	if err != nil || int64(len(decoded)) > maxBytes {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// StatusRewriteConfig represents the rewrite of the status code of
+// responses.
+type StatusRewriteConfig struct {
+	// Status sent to the client instead.
+	Status int `json:"status"`
+	// Body replaces the body of the response when set. It is preserved
+	// otherwise.
+	Body *string `json:"body"`
+}
+
+// validateStatusRewrites checks that the status code rewrites are valid.
+func validateStatusRewrites(rewrites map[int]StatusRewriteConfig) error {
+	for status, rewrite := range rewrites {
+		if status < 200 || status > 599 {
+			return fmt.Errorf("parsing statusRewrites: invalid status code %d", status)
+		}
+		if rewrite.Status < 200 || rewrite.Status > 599 {
+			return fmt.Errorf("parsing statusRewrites: invalid status code %d for %d", rewrite.Status, status)
+		}
+	}
+	return nil
+}
+
+// rewriteStatus applies the rewrite of the status code of res, if any.
+func rewriteStatus(res *http.Response, rewrites map[int]StatusRewriteConfig) error {
+	rewrite, ok := rewrites[res.StatusCode]
+	if !ok {
+		return nil
+	}
+
+	res.StatusCode = rewrite.Status
+	res.Status = fmt.Sprintf("%d %s", rewrite.Status, http.StatusText(rewrite.Status))
+	if rewrite.Body == nil {
+		return nil
+	}
+
+	if err := res.Body.Close(); err != nil {
+		return err
+	}
+	res.Body = io.NopCloser(strings.NewReader(*rewrite.Body))
+	res.ContentLength = int64(len(*rewrite.Body))
+	res.Trailer = nil
+	res.Header.Del("Trailer")
+	res.Header.Del("Content-Encoding")
+	res.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	res.Header.Set("Content-Length", strconv.Itoa(len(*rewrite.Body)))
+	return nil
+}
+
+// rewriteLocation rewrites the Location header of redirect responses
+// pointing at the server, or at one of hosts, to the host r was sent to.
+func rewriteLocation(r *http.Request, res *http.Response, hosts []string) {
+	if res.StatusCode < 300 || res.StatusCode > 399 {
+		return
+	}
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || !location.IsAbs() {
+		return
+	}
+	// Default ports are optional in the hosts.
+	locationHost := stripDefaultPort(location.Scheme, location.Host)
+	if !strings.EqualFold(locationHost, stripDefaultPort(res.Request.URL.Scheme, res.Request.URL.Host)) &&
+		!slices.ContainsFunc(hosts, func(host string) bool {
+			return strings.EqualFold(stripDefaultPort(location.Scheme, host), locationHost)
+		}) {
+		return
+	}
+
+	location.Scheme = "http"
+	if r.TLS != nil {
+		location.Scheme = "https"
+	}
+	location.Host = r.Host
+	res.Header.Set("Location", location.String())
+}
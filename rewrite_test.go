@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRewriteLocation(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		status   int
+		location string
+		hosts    []string
+		want     string
+	}{
+		{"internal", http.StatusFound, "http://backend/login", nil, "http://lb.example/login"},
+		{"internal with default port", http.StatusFound, "http://backend:80/login", nil, "http://lb.example/login"},
+		{"internal https", http.StatusMovedPermanently, "https://backend:443/login?next=%2F", nil, "http://lb.example/login?next=%2F"},
+		{"other port", http.StatusFound, "http://backend:8080/login", nil, "http://backend:8080/login"},
+		{"external", http.StatusFound, "https://sso.example/login", nil, "https://sso.example/login"},
+		{"listed host", http.StatusFound, "http://cdn.internal/a", []string{"cdn.internal:80"}, "http://lb.example/a"},
+		{"relative", http.StatusFound, "/login", nil, "/login"},
+		{"not a redirect", http.StatusCreated, "http://backend/items/1", nil, "http://backend/items/1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://lb.example/", nil)
+			// The URL of the proxied request is normalized.
+			upstream, err := url.Parse("http://backend/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := &http.Response{
+				StatusCode: tt.status,
+				Header:     http.Header{"Location": {tt.location}},
+				Request:    &http.Request{URL: upstream},
+			}
+			rewriteLocation(r, res, tt.hosts)
+			if got := res.Header.Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteLocationProxied(t *testing.T) {
+	var backendURL string
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, backendURL+"/next", http.StatusFound)
+	})
+	backendURL = backend.URL
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"rewriteLocation": true
+	}`, backend.URL))
+
+	w := serve(lb, httptest.NewRequest("GET", "http://lb.example/", nil))
+	if got := w.Header().Get("Location"); got != "http://lb.example/next" {
+		t.Errorf("Location = %q, want %q", got, "http://lb.example/next")
+	}
+}
+
+func TestRewriteBody(t *testing.T) {
+	const content = "<a href=\"http://internal.example/a\">http://internal.example</a>"
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+		case "/data":
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Write([]byte(content))
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"responseRewrites": [{"contentType": "text/html", "find": "http://internal.example", "replace": "https://www.example"}]
+	}`, backend.URL))
+
+	const rewritten = "<a href=\"https://www.example/a\">https://www.example</a>"
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"/page", rewritten},
+		{"/image", content},
+		{"/data", content},
+	} {
+		w := serve(lb, httptest.NewRequest("GET", tt.path, nil))
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s answered %q, want %q", tt.path, got, tt.want)
+		}
+		if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(tt.want)) {
+			t.Errorf("%s answered with Content-Length %s, want %d", tt.path, got, len(tt.want))
+		}
+	}
+}
+
+func TestValidateRewrites(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		rules []RewriteConfig
+		ok    bool
+	}{
+		{"text", []RewriteConfig{{ContentType: "text/html", Find: "a"}}, true},
+		{"json", []RewriteConfig{{ContentType: "application/problem+json", Find: "a"}}, true},
+		{"binary", []RewriteConfig{{ContentType: "image/png", Find: "a"}}, false},
+		{"no find", []RewriteConfig{{ContentType: "text/html"}}, false},
+	} {
+		if err := validateRewrites(tt.rules); (err == nil) != tt.ok {
+			t.Errorf("validateRewrites with %s rule = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestRewriteStatus(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"internal": %d}`, status)
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"statusRewrites": {"418": {"status": 503}, "500": {"status": 502, "body": "Bad Gateway"}}
+	}`, backend.URL))
+
+	for _, tt := range []struct {
+		path        string
+		status      int
+		body        string
+		contentType string
+	}{
+		{"/418", http.StatusServiceUnavailable, `{"internal": 418}`, "application/json"},
+		{"/500", http.StatusBadGateway, "Bad Gateway", "text/plain; charset=utf-8"},
+		{"/404", http.StatusNotFound, `{"internal": 404}`, "application/json"},
+		{"/200", http.StatusOK, `{"internal": 200}`, "application/json"},
+	} {
+		w := serve(lb, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.status || w.Body.String() != tt.body || w.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("%s answered %d %q %q, want %d %q %q", tt.path, w.Code, w.Header().Get("Content-Type"), w.Body, tt.status, tt.contentType, tt.body)
+		}
+	}
+}
+
+func TestValidateStatusRewrites(t *testing.T) {
+	for _, tt := range []struct {
+		rewrites map[int]StatusRewriteConfig
+		ok       bool
+	}{
+		{map[int]StatusRewriteConfig{500: {Status: 502}}, true},
+		{map[int]StatusRewriteConfig{99: {Status: 502}}, false},
+		{map[int]StatusRewriteConfig{500: {Status: 600}}, false},
+		{map[int]StatusRewriteConfig{500: {}}, false},
+	} {
+		if err := validateStatusRewrites(tt.rewrites); (err == nil) != tt.ok {
+			t.Errorf("validateStatusRewrites(%v) = %v, want ok %v", tt.rewrites, err, tt.ok)
+		}
+	}
+}
+
+// gzipped returns s compressed with gzip.
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRewriteGzipBody(t *testing.T) {
+	const content = "see http://internal.example"
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.URL.Path == "/corrupt" {
+			w.Write([]byte("not gzip"))
+			return
+		}
+		w.Write(gzipped(t, content))
+	})
+	for _, tt := range []struct {
+		name, config, path, want string
+	}{
+		{"decoded", `"decodeGzip": true,`, "/", "see https://www.example"},
+		{"not decoded", "", "/", content},
+		{"invalid gzip", `"decodeGzip": true,`, "/corrupt", "not gzip"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}],
+				"responseRewrites": [{"contentType": "text/plain", "find": "http://internal.example", "replace": "https://www.example"}],
+				%s
+				"disableHealthChecks": true
+			}`, backend.URL, tt.config))
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := serve(lb, r)
+
+			if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Errorf("Content-Encoding = %q, want gzip", got)
+			}
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("Content-Length = %s, want %d", got, w.Body.Len())
+			}
+			body := w.Body.Bytes()
+			if tt.path != "/corrupt" {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
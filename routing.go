@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// defaultPoolName is the name of the pool made of the top-level servers.
+const defaultPoolName = "default"
+
+// PoolConfig represents the configuration of a pool of servers.
+type PoolConfig struct {
+	// Servers contains a list of servers.
+	Servers []ServerConfig `json:"servers"`
+	// PreserveHost overrides Config.PreserveHost when set.
+	PreserveHost *bool `json:"preserveHost"`
+	// Algorithm overrides Config.Algorithm when set.
+	Algorithm string `json:"algorithm"`
+	// StripPrefix is removed from the start of the request paths, e.g.
+	// "/api" turns "/api/users" into "/users".
+	StripPrefix string `json:"stripPrefix"`
+	// AddPrefix is prepended to the request paths, after StripPrefix is
+	// removed, e.g. "/service-a" turns "/users" into "/service-a/users".
+	AddPrefix string `json:"addPrefix"`
+}
+
+// RouteConfig represents a routing rule sending matching requests to a pool.
+//
+// Exactly one of PathPrefix and PathRegex must be set.
+type RouteConfig struct {
+	// Name of the route, defaults to its path prefix or regex.
+	Name string `json:"name"`
+	// PathPrefix matches request paths starting with it at a segment
+	// boundary, "/api" matches "/api" and "/api/users" but not "/apis".
+	PathPrefix string `json:"pathPrefix"`
+	// PathRegex matches request paths matching the regular expression.
+	PathRegex string `json:"pathRegex"`
+	// Pool is the name of the pool handling matching requests.
+	Pool string `json:"pool"`
+}
+
+// Pool represents a group of servers requests are balanced across.
+type Pool struct {
+	// Name of the pool.
+	Name string
+	// Servers of the pool.
+	Servers []*Server
+	// PreserveHost forwards the Host header of the client.
+	PreserveHost bool
+	// Algorithm of the balancer.
+	Algorithm string
+	// Balancer selects the server of the pool that handles a request.
+	Balancer Balancer
+	// StripPrefix and AddPrefix rewrite the request paths, see PoolConfig.
+	StripPrefix string
+	AddPrefix   string
+
+	// changedMu serializes the notifications of the balancer, so that
+	// the last one sees the last weights, e.g. set concurrently.
+	changedMu sync.Mutex
+}
+
+// serversChanged notifies the balancer of the pool that its servers
+// changed.
+func (pool *Pool) serversChanged() {
+	pool.changedMu.Lock()
+	defer pool.changedMu.Unlock()
+	pool.Balancer.OnServersChanged(pool.Servers)
+}
+
+// parsePathPrefix validates a path prefix and returns it without its
+// trailing slash.
+func parsePathPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return "", fmt.Errorf("%q must start with /", prefix)
+	}
+	if strings.ContainsAny(prefix, "?#") {
+		return "", fmt.Errorf("%q must not contain a query or fragment", prefix)
+	}
+	return strings.TrimRight(prefix, "/"), nil
+}
+
+// rewritePath removes the StripPrefix of the pool from the path of u and
+// prepends its AddPrefix. The prefix is only removed at a segment
+// boundary, "/api" is not removed from "/apis".
+func (pool *Pool) rewritePath(u *url.URL) {
+	if pool.StripPrefix == "" && pool.AddPrefix == "" {
+		return
+	}
+	rewritePath(u, pool.StripPrefix, pool.AddPrefix)
+}
+
+// rewritePath removes strip from the start of the path of u, at a
+// segment boundary, and prepends add. It reports whether strip was
+// removed.
+func rewritePath(u *url.URL, strip, add string) bool {
+	p := u.EscapedPath()
+	stripped := false
+	if strip != "" {
+		if rest, ok := cutPathPrefix(p, strip); ok {
+			p = rest
+			stripped = true
+		}
+	}
+	if p == "" {
+		p = "/"
+	}
+	p = add + p
+
+	path, err := url.PathUnescape(p)
+	if err != nil {
+		// The path was escaped by u.
+		return stripped
+	}
+	u.Path = path
+	u.RawPath = p
+	return stripped
+}
+
+// cutPathPrefix returns p without prefix, and reports whether p starts
+// with prefix at a segment boundary. A trailing slash of prefix is
+// ignored, "/api/" matches "/api" and "/api/users" too.
+func cutPathPrefix(p, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(p, strings.TrimSuffix(prefix, "/"))
+	if !ok || (rest != "" && rest[0] != '/') {
+		return p, false
+	}
+	return rest, true
+}
+
+// withBasePath serves the requests under basePath with h, removing it
+// from their path, and the others with notFound. Proxied requests carry
+// it in the X-Forwarded-Prefix header.
+func withBasePath(basePath string, h http.Handler, notFound http.HandlerFunc) http.Handler {
+	if basePath == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.Clone(r.Context())
+		if !rewritePath(r2.URL, basePath, "") {
+			notFound(w, r)
+			return
+		}
+		r2.Header.Set("X-Forwarded-Prefix", basePath)
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// Route represents a routing rule.
+type Route struct {
+	// Name of the route.
+	Name string
+	// Prefix matched by the route, empty for regex routes.
+	Prefix string
+	// Regex matched by the route, nil for prefix routes.
+	Regex *regexp.Regexp
+	// Pool handling matching requests.
+	Pool *Pool
+}
+
+// Router selects the route of a request.
+//
+// Prefix routes take precedence over regex routes, and the longest
+// matching prefix wins. Regex routes are then tried in configuration
+// order. Requests matching no route go to the default route, if any,
+// and are answered with 404 otherwise.
+type Router struct {
+	prefixes []*Route
+	regexes  []*Route
+	fallback *Route
+}
+
+// newRouter returns a router for routes, which refer to pools by name.
+//
+// Requests matching no route go to the pool named defaultPool, or to
+// the default pool if it is nil and that pool exists. An empty
+// defaultPool answers them with 404.
+func newRouter(routes []RouteConfig, pools map[string]*Pool, defaultPool *string) (*Router, error) {
+	router := &Router{}
+
+	for i, rc := range routes {
+		pool, ok := pools[rc.Pool]
+		if !ok {
+			return nil, fmt.Errorf("parsing routes: route %d refers to unknown pool %q", i, rc.Pool)
+		}
+
+		route := &Route{Name: rc.Name, Pool: pool}
+		switch {
+		case rc.PathPrefix != "" && rc.PathRegex == "":
+			route.Prefix = rc.PathPrefix
+			if route.Name == "" {
+				route.Name = rc.PathPrefix
+			}
+			router.prefixes = append(router.prefixes, route)
+		case rc.PathRegex != "" && rc.PathPrefix == "":
+			re, err := regexp.Compile(rc.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("parsing routes: route %d: %w", i, err)
+			}
+			route.Regex = re
+			if route.Name == "" {
+				route.Name = rc.PathRegex
+			}
+			router.regexes = append(router.regexes, route)
+		default:
+			return nil, fmt.Errorf("parsing routes: route %d needs exactly one of pathPrefix and pathRegex", i)
+		}
+	}
+
+	switch {
+	case defaultPool == nil:
+		if pool, ok := pools[defaultPoolName]; ok {
+			router.fallback = &Route{Name: defaultPoolName, Pool: pool}
+		}
+	case *defaultPool != "":
+		pool, ok := pools[*defaultPool]
+		if !ok {
+			return nil, fmt.Errorf("parsing defaultPool: unknown pool %q", *defaultPool)
+		}
+		router.fallback = &Route{Name: pool.Name, Pool: pool}
+	}
+
+	return router, nil
+}
+
+// Routes returns the routes in the order they are matched, the default
+// route being last.
+func (router *Router) Routes() []*Route {
+	routes := slices.Clone(router.prefixes)
+	slices.SortStableFunc(routes, func(a, b *Route) int { return len(b.Prefix) - len(a.Prefix) })
+	routes = append(routes, router.regexes...)
+	if router.fallback != nil {
+		routes = append(routes, router.fallback)
+	}
+	return routes
+}
+
+// Match returns the route of r, or nil if there is none.
+func (router *Router) Match(r *http.Request) *Route {
+	path := r.URL.Path
+
+	var longest *Route
+	for _, route := range router.prefixes {
+		if _, ok := cutPathPrefix(path, route.Prefix); ok && (longest == nil || len(route.Prefix) > len(longest.Prefix)) {
+			longest = route
+		}
+	}
+	if longest != nil {
+		return longest
+	}
+
+	for _, route := range router.regexes {
+		if route.Regex.MatchString(path) {
+			return route
+		}
+	}
+
+	return router.fallback
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRouterMatch(t *testing.T) {
+	pools := map[string]*Pool{}
+	for _, name := range []string{defaultPoolName, "api", "v2", "static", "images", "slash"} {
+		pools[name] = &Pool{Name: name}
+	}
+	router, err := newRouter([]RouteConfig{
+		{PathPrefix: "/api", Pool: "api"},
+		{PathPrefix: "/api/v2", Pool: "v2"},
+		{PathPrefix: "/docs/", Pool: "slash"},
+		{PathRegex: `\.(png|jpg)$`, Pool: "images"},
+		{PathRegex: `logo`, Pool: "static"},
+	}, pools, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"/api", "api"},
+		{"/api/users", "api"},
+		{"/apis", defaultPoolName},
+		{"/api-docs", defaultPoolName},
+		{"/api/v2", "v2"},
+		{"/api/v2/users", "v2"},
+		{"/api/v20", "api"},
+		{"/docs", "slash"},
+		{"/docs/intro", "slash"},
+		{"/docsite", defaultPoolName},
+		// Prefix routes take precedence over regex routes.
+		{"/api/logo.png", "api"},
+		// Regex routes are tried in order.
+		{"/img/logo.png", "images"},
+		{"/img/logo.svg", "static"},
+		{"/", defaultPoolName},
+	} {
+		route := router.Match(httptest.NewRequest("GET", tt.path, nil))
+		if route == nil || route.Pool.Name != tt.want {
+			got := "none"
+			if route != nil {
+				got = route.Pool.Name
+			}
+			t.Errorf("Match(%q) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRouterNoDefault(t *testing.T) {
+	pools := map[string]*Pool{defaultPoolName: {Name: defaultPoolName}, "api": {Name: "api"}}
+	none := ""
+	router, err := newRouter([]RouteConfig{{PathPrefix: "/api", Pool: "api"}}, pools, &none)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route := router.Match(httptest.NewRequest("GET", "/apis", nil)); route != nil {
+		t.Errorf("Match(/apis) = %s, want none", route.Name)
+	}
+}
+
+func TestNewRouterErrors(t *testing.T) {
+	pools := map[string]*Pool{"api": {Name: "api"}}
+	unknown := "missing"
+	for _, tt := range []struct {
+		name        string
+		routes      []RouteConfig
+		defaultPool *string
+	}{
+		{"invalid regex", []RouteConfig{{PathRegex: `(`, Pool: "api"}}, nil},
+		{"prefix and regex", []RouteConfig{{PathPrefix: "/api", PathRegex: `^/api`, Pool: "api"}}, nil},
+		{"neither prefix nor regex", []RouteConfig{{Pool: "api"}}, nil},
+		{"unknown pool", []RouteConfig{{PathPrefix: "/api", Pool: "missing"}}, nil},
+		{"unknown default pool", nil, &unknown},
+	} {
+		if _, err := newRouter(tt.routes, pools, tt.defaultPool); err == nil {
+			t.Errorf("%s: newRouter returned no error", tt.name)
+		}
+	}
+}
+
+func TestPoolAlgorithms(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	a, b, c, d := newBackend(t, handler), newBackend(t, handler), newBackend(t, handler), newBackend(t, handler)
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q, "priority": 1}, {"url": %q, "priority": 0}],
+		"algorithm": "failover",
+		"pools": {"api": {"servers": [{"url": %q}, {"url": %q, "weight": 3}], "algorithm": "weighted-random"}},
+		"routes": [{"pathPrefix": "/api", "pool": "api"}],
+		"disableHealthChecks": true
+	}`, a.URL, b.URL, c.URL, d.URL))
+	st := lb.State()
+	if got := st.Pools["api"].Algorithm; got != "weighted-random" {
+		t.Errorf("algorithm of pool api = %q, want weighted-random", got)
+	}
+	if got := st.Pools[defaultPoolName].Algorithm; got != "failover" {
+		t.Errorf("algorithm of the default pool = %q, want failover", got)
+	}
+
+	for range 1000 {
+		serve(lb, httptest.NewRequest("GET", "/", nil))
+		serve(lb, httptest.NewRequest("GET", "/api/users", nil))
+	}
+	requests := map[string]int64{}
+	for _, server := range st.Servers {
+		requests[server.URL.String()] = server.Requests.Load()
+	}
+	if requests[a.URL] != 0 || requests[b.URL] != 1000 {
+		t.Errorf("default pool servers got %d and %d requests, want all to the preferred one", requests[a.URL], requests[b.URL])
+	}
+	// The shares are 0.25 and 0.75.
+	if requests[c.URL]+requests[d.URL] != 1000 || requests[d.URL] < 680 || requests[d.URL] > 820 {
+		t.Errorf("api pool servers got %d and %d requests, want 250 and 750", requests[c.URL], requests[d.URL])
+	}
+}
+
+func TestPoolUnknownAlgorithm(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `{
+		"servers": ["backend"],
+		"pools": {"api": {"servers": ["api"], "algorithm": "fastest"}},
+		"routes": [{"pathPrefix": "/api", "pool": "api"}],
+		"disableHealthChecks": true
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newState(c); err == nil || !strings.Contains(err.Error(), `pool "api"`) {
+		t.Errorf("newState with an unknown pool algorithm = %v, want an error naming the pool", err)
+	}
+}
+
+func TestDefaultPool(t *testing.T) {
+	name := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, name) }
+	}
+	top, api := newBackend(t, name("top")), newBackend(t, name("api"))
+	for _, tt := range []struct {
+		name        string
+		defaultPool string
+		status      int
+		body        string
+	}{
+		{"top-level servers", "", http.StatusOK, "top"},
+		{"named pool", `"defaultPool": "api",`, http.StatusOK, "api"},
+		{"none", `"defaultPool": "",`, http.StatusNotFound, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}],
+				"pools": {"api": {"servers": [{"url": %q}]}},
+				"routes": [{"pathPrefix": "/api", "pool": "api"}],
+				%s
+				"disableHealthChecks": true
+			}`, top.URL, api.URL, tt.defaultPool))
+
+			w := serve(lb, httptest.NewRequest("GET", "/other", nil))
+			if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+				t.Errorf("unmatched request got %d %q, want %d %q", w.Code, w.Body, tt.status, tt.body)
+			}
+			if w := serve(lb, httptest.NewRequest("GET", "/api", nil)); w.Body.String() != "api" {
+				t.Errorf("matched request answered by %q, want api", w.Body)
+			}
+		})
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	for _, tt := range []struct {
+		path, strip, add string
+		want             string
+		stripped         bool
+	}{
+		{"/api/users", "/api", "", "/users", true},
+		{"/api", "/api", "", "/", true},
+		{"/api/", "/api", "", "/", true},
+		{"/apis", "/api", "", "/apis", false},
+		{"/other", "/api", "", "/other", false},
+		{"/users", "", "/service-a", "/service-a/users", false},
+		{"/api/users", "/api", "/v1", "/v1/users", true},
+		{"/api", "/api", "/v1", "/v1/", true},
+		// Escaped characters are kept.
+		{"/api/a%2Fb", "/api", "/v1", "/v1/a%2Fb", true},
+		{"/api/caf%C3%A9", "/api", "", "/caf%C3%A9", true},
+	} {
+		u, err := url.Parse("http://lb.example" + tt.path + "?q=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stripped := rewritePath(u, tt.strip, tt.add)
+		if got := u.EscapedPath(); got != tt.want || stripped != tt.stripped || u.RawQuery != "q=1" {
+			t.Errorf("rewritePath(%q, %q, %q) = %q?%s, %v, want %q?q=1, %v", tt.path, tt.strip, tt.add, got, u.RawQuery, stripped, tt.want, tt.stripped)
+		}
+	}
+}
+
+func TestPoolPathPrefixes(t *testing.T) {
+	var got string
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"pools": {"api": {"servers": [{"url": %[1]q}], "stripPrefix": "/api/", "addPrefix": "/service-a"}},
+		"routes": [{"pathPrefix": "/api", "pool": "api"}],
+		"disableHealthChecks": true
+	}`, backend.URL))
+
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"/api/users?page=2", "/service-a/users?page=2"},
+		{"/api", "/service-a/"},
+		{"/users", "/users"},
+	} {
+		serve(lb, httptest.NewRequest("GET", tt.path, nil))
+		if got != tt.want {
+			t.Errorf("%s proxied as %s, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	for _, prefix := range []string{"api", "/api?x=1", "/api#top"} {
+		if _, err := parsePathPrefix(prefix); err == nil {
+			t.Errorf("parsePathPrefix(%q) succeeded", prefix)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	var got, prefix string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		got = r.Host + r.URL.RequestURI()
+		prefix = r.Header.Get("X-Forwarded-Prefix")
+	}
+	backend, api := newBackend(t, handler), newBackend(t, handler)
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"pools": {"api": {"servers": [{"url": %q}]}},
+		"routes": [{"pathPrefix": "/api", "pool": "api"}],
+		"disableHealthChecks": true
+	}`, backend.URL, api.URL))
+	h := withBasePath("/lb", lb, lb.NotFound)
+	admin := withBasePath("/lb", newAdminHandler(&AdminConfig{}, lb), lb.NotFound)
+
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/lb/api/users?page=2", api.Listener.Addr().String() + "/api/users?page=2"},
+		{"/lb/", backend.Listener.Addr().String() + "/"},
+		{"/lb", backend.Listener.Addr().String() + "/"},
+		{"/lb/apis", backend.Listener.Addr().String() + "/apis"},
+	} {
+		got, prefix = "", ""
+		r := httptest.NewRequest("GET", tt.path, nil)
+		// Set by the client.
+		r.Header.Set("X-Forwarded-Prefix", "/spoofed")
+		if code := serve(h, r).Code; code != http.StatusOK {
+			t.Errorf("%s got %d, want 200", tt.path, code)
+		}
+		if got != tt.want || prefix != "/lb" {
+			t.Errorf("%s proxied to %s with X-Forwarded-Prefix %q, want %s with /lb", tt.path, got, prefix, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		h    http.Handler
+		path string
+		want int
+	}{
+		{h, "/api/users", http.StatusNotFound},
+		{h, "/lbx/api", http.StatusNotFound},
+		{admin, "/lb/admin/servers", http.StatusOK},
+		{admin, "/lb/metrics", http.StatusOK},
+		{admin, "/lb/healthz", http.StatusOK},
+		{admin, "/admin/servers", http.StatusNotFound},
+		{admin, "/metrics", http.StatusNotFound},
+	} {
+		if code := serve(tt.h, httptest.NewRequest("GET", tt.path, nil)).Code; code != tt.want {
+			t.Errorf("%s got %d, want %d", tt.path, code, tt.want)
+		}
+	}
+
+	c, err := loadConfig(writeConfig(t, `{"servers": ["backend:80"], "basePath": "lb", "disableHealthChecks": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newStartupOptions(c); err == nil || !strings.Contains(err.Error(), "basePath") {
+		t.Errorf("options with the base path \"lb\": %v, want a basePath error", err)
+	}
+}
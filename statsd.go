@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxStatsDPacketBytes is the maximum size of the StatsD packets, below
+// the usual MTU.
+const maxStatsDPacketBytes = 1432
+
+// StatsD formats.
+const (
+	// statsdPlain puts the labels in the metric names.
+	statsdPlain = "statsd"
+	// statsdDog puts the labels in DogStatsD tags.
+	statsdDog = "dogstatsd"
+)
+
+// statsdNameEscaper matches the characters not allowed in plain StatsD
+// metric names.
+var statsdNameEscaper = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// statsdTagEscaper escapes the characters not allowed in DogStatsD tags.
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// StatsDConfig represents the configuration of the StatsD exporter.
+type StatsDConfig struct {
+	// Address of the StatsD server, e.g. "127.0.0.1:8125".
+	Address string `json:"address"`
+	// Interval between two pushes of the metrics, defaults to 10s.
+	Interval Duration `json:"interval"`
+	// Prefix of the metric names, defaults to "lb.".
+	Prefix *string `json:"prefix"`
+	// Format of the metrics, "statsd" (default) or "dogstatsd".
+	Format string `json:"format"`
+}
+
+// statsdExporter periodically pushes the metrics to a StatsD server over
+// UDP.
+type statsdExporter struct {
+	address  string
+	interval time.Duration
+	prefix   string
+	format   string
+
+	// last contains the last pushed value of the counters, StatsD
+	// counters being pushed as increments.
+	last map[string]float64
+}
+
+// newStatsDExporter returns the exporter described by config, or nil if
+// there is none.
+func newStatsDExporter(config *StatsDConfig) (*statsdExporter, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		return nil, fmt.Errorf("parsing statsd.address: %w", err)
+	}
+	interval := time.Duration(config.Interval)
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("parsing statsd.interval: must be greater than 0")
+	}
+	prefix := "lb."
+	if config.Prefix != nil {
+		prefix = *config.Prefix
+	}
+	format := config.Format
+	switch format {
+	case "":
+		format = statsdPlain
+	case statsdPlain, statsdDog:
+	default:
+		return nil, fmt.Errorf("parsing statsd.format: unknown format %q", config.Format)
+	}
+	return &statsdExporter{
+		address:  config.Address,
+		interval: interval,
+		prefix:   prefix,
+		format:   format,
+		last:     make(map[string]float64),
+	}, nil
+}
+
+// Run pushes the metrics of lb every interval.
+func (e *statsdExporter) Run(lb *LoadBalancer) {
+	conn, err := net.Dial("udp", e.address)
+	if err != nil {
+		slog.Error("Error connecting to StatsD", "address", e.address, "error", err)
+		return
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, packet := range packStatsD(e.lines(lb)) {
+			if _, err := conn.Write(packet); err != nil {
+				slog.Error("Error pushing metrics to StatsD", "address", e.address, "error", err)
+				break
+			}
+		}
+	}
+}
+
+// lines returns the metric lines to push for lb.
+func (e *statsdExporter) lines(lb *LoadBalancer) []string {
+	st := lb.State()
+	var lines []string
+
+	for labels, v := range lb.Metrics.Requests.snapshot() {
+		lines = append(lines, e.counter("requests", parseLabels(labels), v))
+	}
+	for labels, v := range lb.Metrics.RequestErrors.snapshot() {
+		lines = append(lines, e.counter("request_errors", parseLabels(labels), v))
+	}
+	// The mean duration of the requests since the last push.
+	for labels, h := range lb.Metrics.RequestDuration.snapshot() {
+		key := "request_duration " + labels
+		count := float64(h.count) - e.last[key+" count"]
+		sum := h.sum - e.last[key+" sum"]
+		e.last[key+" count"], e.last[key+" sum"] = float64(h.count), h.sum
+		if count > 0 {
+			lines = append(lines, e.line("request_duration_ms", parseLabels(labels), sum/count*1000, "g"))
+		}
+	}
+
+	var depth int64
+	if st.Queue != nil {
+		depth = st.Queue.Depth()
+	}
+	lines = append(lines, e.line("queue_depth", nil, float64(depth), "g"))
+	lines = append(lines, e.line("in_flight", nil, float64(lb.InFlight()), "g"))
+
+	for _, s := range st.Servers {
+		var labels [][2]string
+		kv := serverLabels(s)
+		for i := 0; i+1 < len(kv); i += 2 {
+			labels = append(labels, [2]string{kv[i], kv[i+1]})
+		}
+		s.Mu.Lock()
+		healthy := 0.0
+		if s.Healthy {
+			healthy = 1
+		}
+		active := s.ActiveConnections
+		lastCheck := s.LastCheck
+		s.Mu.Unlock()
+
+		lines = append(lines, e.line("server.healthy", labels, healthy, "g"))
+		lines = append(lines, e.line("server.active_connections", labels, float64(active), "g"))
+		lines = append(lines, e.counter("server.requests", labels, float64(s.Requests.Load())))
+		if !lastCheck.Time.IsZero() {
+			lines = append(lines, e.line("server.check_latency_ms", labels, lastCheck.Latency.Seconds()*1000, "g"))
+		}
+	}
+	return lines
+}
+
+// counter returns the line of the increment of the counter name since
+// the last push, its total being v.
+func (e *statsdExporter) counter(name string, labels [][2]string, v float64) string {
+	line := e.line(name, labels, 0, "c")
+	delta := v - e.last[line]
+	e.last[line] = v
+	return e.line(name, labels, delta, "c")
+}
+
+// line returns the line of the metric name with the given labels.
+func (e *statsdExporter) line(name string, labels [][2]string, v float64, typ string) string {
+	var b strings.Builder
+	b.WriteString(e.prefix)
+	b.WriteString(name)
+	if e.format == statsdPlain {
+		for _, l := range labels {
+			b.WriteByte('.')
+			b.WriteString(statsdNameEscaper.ReplaceAllString(l[1], "_"))
+		}
+	}
+	// Rounded to the microsecond for the durations in milliseconds.
+	fmt.Fprintf(&b, ":%s|%s", strconv.FormatFloat(math.Round(v*1000)/1000, 'f', -1, 64), typ)
+	if e.format == statsdDog {
+		for i, l := range labels {
+			if i == 0 {
+				b.WriteString("|#")
+			} else {
+				b.WriteByte(',')
+			}
+			b.WriteString(l[0] + ":" + statsdTagEscaper.Replace(l[1]))
+		}
+	}
+	return b.String()
+}
+
+// packStatsD joins lines into packets of at most maxStatsDPacketBytes.
+func packStatsD(lines []string) [][]byte {
+	var packets [][]byte
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > maxStatsDPacketBytes {
+			packets = append(packets, packet)
+			packet = nil
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// parseLabels returns the label pairs of labels, in the Prometheus text
+// format.
+func parseLabels(labels string) [][2]string {
+	var pairs [][2]string
+	for labels != "" {
+		name, rest, ok := strings.Cut(labels, `="`)
+		if !ok {
+			break
+		}
+		var value strings.Builder
+		i := 0
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\\' && i+1 < len(rest) {
+				i++
+				if rest[i] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(rest[i])
+		}
+		pairs = append(pairs, [2]string{name, value.String()})
+		labels = strings.TrimPrefix(rest[min(i+1, len(rest)):], ",")
+	}
+	return pairs
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDLines(t *testing.T) {
+	for _, tt := range []struct {
+		format string
+		want   []string
+	}{
+		{statsdDog, []string{
+			"lb.requests:2|c|#route:default,code:200",
+			"lb.request_duration_ms:10|g|#route:default",
+			"lb.queue_depth:0|g",
+			"lb.in_flight:0|g",
+			"lb.server.healthy:1|g|#server:http://backend,zone:eu-west",
+			"lb.server.active_connections:1|g|#server:http://backend,zone:eu-west",
+			"lb.server.requests:3|c|#server:http://backend,zone:eu-west",
+		}},
+		{statsdPlain, []string{
+			"lb.requests.default.200:2|c",
+			"lb.request_duration_ms.default:10|g",
+			"lb.server.healthy.http___backend.eu-west:1|g",
+			"lb.server.requests.http___backend.eu-west:3|c",
+		}},
+	} {
+		t.Run(tt.format, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, `{
+				"servers": [{"url": "backend:80", "labels": {"zone": "eu-west"}}],
+				"disableHealthChecks": true
+			}`)
+			server := lb.State().Servers[0]
+			server.ActiveConnections = 1
+			server.Requests.Store(3)
+			lb.Metrics.ObserveRequest("default", 200, 5*time.Millisecond)
+			lb.Metrics.ObserveRequest("default", 200, 15*time.Millisecond)
+
+			e, err := newStatsDExporter(&StatsDConfig{Address: "127.0.0.1:8125", Format: tt.format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := e.lines(lb)
+			for _, line := range tt.want {
+				if !slices.Contains(lines, line) {
+					t.Errorf("missing %s in\n%s", line, strings.Join(lines, "\n"))
+				}
+			}
+
+			// Counters are pushed as increments, durations as the mean since
+			// the last push.
+			lines = e.lines(lb)
+			for _, line := range lines {
+				if strings.HasPrefix(line, "lb.requests") && !strings.Contains(line, ":0|c") {
+					t.Errorf("request counter pushed again as %s, want no increment", line)
+				}
+				if strings.HasPrefix(line, "lb.request_duration_ms") {
+					t.Errorf("duration without new requests pushed as %s", line)
+				}
+			}
+		})
+	}
+}
+
+func TestStatsDExporter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	lb := newTestLoadBalancer(t, `{"servers": ["backend:80"], "disableHealthChecks": true}`)
+	lb.Metrics.ObserveRequest("default", 200, time.Millisecond)
+	e, err := newStatsDExporter(&StatsDConfig{Address: conn.LocalAddr().String(), Interval: Duration(20 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Run(lb)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65536)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	for _, line := range []string{"lb.requests.default.200:1|c", "lb.server.healthy.http___backend:1|g"} {
+		if !slices.Contains(lines, line) {
+			t.Errorf("missing %s in the packet\n%s", line, buf[:n])
+		}
+	}
+}
+
+func TestPackStatsD(t *testing.T) {
+	line := strings.Repeat("x", 500)
+	packets := packStatsD([]string{line, line, line, "short"})
+	if len(packets) != 2 {
+		t.Fatalf("%d packets, want 2", len(packets))
+	}
+	for i, want := range []string{line + "\n" + line, line + "\n" + "short"} {
+		if string(packets[i]) != want {
+			t.Errorf("packet %d has %d bytes, want %d", i, len(packets[i]), len(want))
+		}
+	}
+	if packets := packStatsD(nil); len(packets) != 0 {
+		t.Errorf("%d packets without lines, want none", len(packets))
+	}
+}
+
+func TestNewStatsDExporter(t *testing.T) {
+	for _, config := range []StatsDConfig{
+		{Address: "localhost"},
+		{Address: "localhost:8125", Interval: Duration(-time.Second)},
+		{Address: "localhost:8125", Format: "graphite"},
+	} {
+		if _, err := newStatsDExporter(&config); err == nil {
+			t.Errorf("newStatsDExporter(%+v) succeeded", config)
+		}
+	}
+}
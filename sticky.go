@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"time"
+)
+
+// stickyCookieName is the name of the cookie pinning a client to a server.
+const stickyCookieName = "lb_affinity"
+
+// Sticky failure modes, used when the pinned server is unhealthy.
+const (
+	// stickyFailover pins the client to a new server.
+	stickyFailover = "failover"
+	// stickyError fails the request.
+	stickyError = "error"
+)
+
+// errStickyServerUnhealthy is returned when the pinned server is unhealthy
+// in the error failure mode.
+var errStickyServerUnhealthy = errors.New("pinned server is unhealthy")
+
+// serverID returns the identifier of the server with the given URL
+// stored in the affinity cookie.
+//
+// The URL is hashed so that the cookie does not leak backend addresses.
+func serverID(rawURL string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(rawURL))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// mergeHeader removes from res the headers already set in header, the
+// response header of the client, by the load balancer, so that they are
+// not duplicated. The Set-Cookie headers of res are kept, except the ones
+// setting a cookie also set in header, e.g. the affinity cookie.
+func mergeHeader(header http.Header, res *http.Response) {
+	set := map[string]bool{}
+	for name, values := range header {
+		if name != "Set-Cookie" {
+			res.Header.Del(name)
+			continue
+		}
+		for _, v := range values {
+			if cookie, err := http.ParseSetCookie(v); err == nil {
+				set[cookie.Name] = true
+			}
+		}
+	}
+	removeCookies(res.Header, set)
+}
+
+// removeCookies removes from header the Set-Cookie headers setting the
+// cookies in names.
+func removeCookies(header http.Header, names map[string]bool) {
+	if len(names) == 0 {
+		return
+	}
+
+	cookies := header["Set-Cookie"]
+	header.Del("Set-Cookie")
+	for _, v := range cookies {
+		if cookie, err := http.ParseSetCookie(v); err == nil && names[cookie.Name] {
+			continue
+		}
+		header.Add("Set-Cookie", v)
+	}
+}
+
+// nextServerSticky returns the server r is pinned to in pool, selecting
+// and pinning a new one with st.nextServer when needed.
+//
+// Clients pinned to a drained server, or to a server of weight 0, are
+// pinned to a new one.
+func (st *State) nextServerSticky(w http.ResponseWriter, r *http.Request, pool *Pool, key string) (*Server, error) {
+	if cookie, err := r.Cookie(stickyCookieName); err == nil {
+		for _, server := range pool.Servers {
+			if server.ID != cookie.Value {
+				continue
+			}
+
+			server.Mu.Lock()
+			healthy := server.Healthy
+			removed := server.Weight == 0 || server.Drain.share(time.Now()) == 0
+			server.Mu.Unlock()
+
+			switch {
+			case removed:
+			case healthy:
+				return server, nil
+			case st.Config.StickyFailureMode == stickyError:
+				return nil, errStickyServerUnhealthy
+			}
+			break
+		}
+	}
+
+	server := st.nextServer(pool, nil, key)
+	if server == nil {
+		// Clear the affinity to the unavailable server.
+		http.SetCookie(w, &http.Cookie{Name: stickyCookieName, Path: "/", MaxAge: -1})
+		return nil, nil
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stickyCookieName,
+		Value:    server.ID,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return server, nil
+}
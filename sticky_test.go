@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// pinnedTo returns a request pinned to s.
+func pinnedTo(s *Server) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: stickyCookieName, Value: s.ID})
+	return r
+}
+
+func TestStickyRepinsRemovedServer(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		remove func(s *Server)
+	}{
+		{"drained", func(s *Server) { s.Drain = &serverDrain{start: time.Now().Add(-time.Minute), duration: time.Second} }},
+		{"weight 0", func(s *Server) { s.Weight = 0 }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newTestState(t, fmt.Sprintf(`{
+				"servers": ["a:80", "b:80"],
+				"algorithm": "weighted-random",
+				"stickySessions": true,
+				"stickyFailureMode": %q,
+				"disableHealthChecks": true
+			}`, stickyError))
+			pool := st.Pools[defaultPoolName]
+			removed, other := st.Servers[0], st.Servers[1]
+			tt.remove(removed)
+
+			for range 20 {
+				w := httptest.NewRecorder()
+				server, err := st.nextServerSticky(w, pinnedTo(removed), pool, "")
+				if err != nil || server != other {
+					t.Fatalf("nextServerSticky = %v, %v, want %s", server, err, other.URL)
+				}
+				if cookie := w.Result().Cookies(); len(cookie) != 1 || cookie[0].Value != other.ID {
+					t.Fatalf("affinity cookie %v, want %s", cookie, other.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestStickyFailureModes(t *testing.T) {
+	for _, tt := range []struct {
+		mode string
+		want int
+	}{
+		{stickyFailover, http.StatusOK},
+		{stickyError, http.StatusServiceUnavailable},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			name := func(name string) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, name) }
+			}
+			lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+				"servers": [{"url": %q}, {"url": %q}],
+				"stickySessions": true,
+				"stickyFailureMode": %q,
+				"disableHealthChecks": true
+			}`, newBackend(t, name("a")).URL, newBackend(t, name("b")).URL, tt.mode))
+
+			// The first request pins the client.
+			w := serve(lb, httptest.NewRequest("GET", "/", nil))
+			cookies := w.Result().Cookies()
+			if w.Code != http.StatusOK || len(cookies) != 1 || cookies[0].Name != stickyCookieName {
+				t.Fatalf("first request got %d with cookies %v, want 200 with the affinity cookie", w.Code, cookies)
+			}
+			pinnedName := w.Body.String()
+			var pinned *Server
+			for _, server := range lb.State().Servers {
+				if server.ID == cookies[0].Value {
+					pinned = server
+				}
+			}
+			if pinned == nil {
+				t.Fatalf("affinity cookie %q matches no server", cookies[0].Value)
+			}
+			for range 5 {
+				if w := serve(lb, pinnedTo(pinned)); w.Body.String() != pinnedName {
+					t.Fatalf("pinned request answered by %q, want %q", w.Body.String(), pinnedName)
+				}
+			}
+
+			pinned.Mu.Lock()
+			pinned.Healthy = false
+			pinned.Mu.Unlock()
+			w = serve(lb, pinnedTo(pinned))
+			if w.Code != tt.want {
+				t.Fatalf("request pinned to an unhealthy server got %d, want %d", w.Code, tt.want)
+			}
+			cookies = w.Result().Cookies()
+			if tt.mode == stickyFailover {
+				if w.Body.String() == pinnedName {
+					t.Error("request pinned to an unhealthy server answered by it")
+				}
+				if len(cookies) != 1 || cookies[0].Value == pinned.ID {
+					t.Errorf("affinity cookie %v, want the client pinned to the other server", cookies)
+				}
+			} else if len(cookies) != 0 {
+				t.Errorf("failed request set cookies %v, want the client still pinned", cookies)
+			}
+
+			// The pinned server recovers.
+			pinned.Mu.Lock()
+			pinned.Healthy = true
+			pinned.Mu.Unlock()
+			if w := serve(lb, pinnedTo(pinned)); w.Code != http.StatusOK || w.Body.String() != pinnedName {
+				t.Errorf("request pinned to a recovered server got %d from %q, want 200 from %q", w.Code, w.Body.String(), pinnedName)
+			}
+		})
+	}
+}
+
+func TestStickyBackendCookies(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+		// The backend cannot clobber the affinity cookie.
+		http.SetCookie(w, &http.Cookie{Name: stickyCookieName, Value: "backend"})
+	})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"stickySessions": true,
+		"disableHealthChecks": true
+	}`, backend.URL))
+	server := lb.State().Servers[0]
+
+	w := serve(lb, httptest.NewRequest("GET", "/", nil))
+	got := map[string][]string{}
+	for _, cookie := range w.Result().Cookies() {
+		got[cookie.Name] = append(got[cookie.Name], cookie.Value)
+	}
+	want := map[string][]string{"session": {"abc"}, "theme": {"dark"}, stickyCookieName: {server.ID}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("client got the cookies %v, want %v", got, want)
+	}
+
+	// Pinned clients get the cookies of the backend only.
+	w = serve(lb, pinnedTo(server))
+	got = map[string][]string{}
+	for _, cookie := range w.Result().Cookies() {
+		got[cookie.Name] = append(got[cookie.Name], cookie.Value)
+	}
+	want = map[string][]string{"session": {"abc"}, "theme": {"dark"}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("pinned client got the cookies %v, want %v", got, want)
+	}
+}
+
+func TestMergeHeader(t *testing.T) {
+	header := http.Header{
+		"Set-Cookie":  {stickyCookieName + "=a1; Path=/; HttpOnly"},
+		"X-Served-By": {"lb"},
+	}
+	res := &http.Response{Header: http.Header{
+		"Set-Cookie":   {"session=abc; Path=/", stickyCookieName + "=b2", "malformed"},
+		"X-Served-By":  {"backend"},
+		"Content-Type": {"text/plain"},
+	}}
+	mergeHeader(header, res)
+	want := http.Header{
+		"Set-Cookie":   {"session=abc; Path=/", "malformed"},
+		"Content-Type": {"text/plain"},
+	}
+	if fmt.Sprint(res.Header) != fmt.Sprint(want) {
+		t.Errorf("merged backend header %v, want %v", res.Header, want)
+	}
+
+	// Without cookies of the load balancer, the ones of the backend are kept.
+	res = &http.Response{Header: http.Header{"Set-Cookie": {"a=1", "a=2"}}}
+	mergeHeader(http.Header{}, res)
+	if got := res.Header["Set-Cookie"]; len(got) != 2 {
+		t.Errorf("backend cookies %v, want both kept", got)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+)
+
+// WarmUpConfig represents the configuration of the connection warm-up.
+type WarmUpConfig struct {
+	// Connections is the number of connections opened to each server.
+	Connections int `json:"connections"`
+	// Timeout of the whole warm-up.
+	Timeout Duration `json:"timeout"`
+}
+
+// warmUp opens connections to each healthy server through its transport
+// so that they are reused by the first proxied requests.
+//
+// It returns once every connection is open or ctx is done.
+func warmUp(ctx context.Context, servers []*Server, connections int) {
+	var wg sync.WaitGroup
+	var opened atomic.Int64
+
+	for _, server := range servers {
+		server.Mu.Lock()
+		healthy := server.Healthy
+		server.Mu.Unlock()
+		if !healthy {
+			continue
+		}
+
+		client := &http.Client{Transport: server.Transport}
+		var logOnce sync.Once
+		// Each request holds its connection until all of them got one, so
+		// that no request reuses the connection of another.
+		var connected sync.WaitGroup
+		connected.Add(connections)
+		for range connections {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				gotConn := sync.OnceFunc(connected.Done)
+				defer gotConn()
+
+				trace := &httptrace.ClientTrace{GotConn: func(httptrace.GotConnInfo) {
+					gotConn()
+					connected.Wait()
+				}}
+				req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, server.URL.String(), nil)
+				if err != nil {
+					return
+				}
+				res, err := client.Do(req)
+				if err != nil {
+					logOnce.Do(func() { slog.Error("Error warming up", "server", server.RedactedURL(), "error", err) })
+					return
+				}
+
+				// Drain the body so the connection goes back to the idle pool.
+				_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, maxHealthCheckBodyBytes))
+				if err := res.Body.Close(); err != nil {
+					slog.Error("Error closing response body", "error", err)
+				}
+				opened.Add(1)
+			}()
+		}
+	}
+
+	wg.Wait()
+	slog.Info("Warmed up connections", "connections", opened.Load(), "servers", len(servers))
+}
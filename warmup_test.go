@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCountingBackend returns a backend served by handler and the number
+// of connections opened to it.
+func newCountingBackend(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var conns atomic.Int64
+	backend := httptest.NewUnstartedServer(handler)
+	backend.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	t.Cleanup(backend.Close)
+	return backend, &conns
+}
+
+func TestWarmUp(t *testing.T) {
+	var block atomic.Bool
+	release := make(chan struct{})
+	backend, conns := newCountingBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if block.Load() {
+			<-release
+		}
+	})
+	unhealthy, unhealthyConns := newCountingBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	lb := newTestLoadBalancer(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}, {"url": %q, "weight": 0}],
+		"disableHealthChecks": true,
+		"warmUp": {"connections": 3, "timeout": "5s"}
+	}`, backend.URL, unhealthy.URL))
+	st := lb.State()
+	st.Servers[1].Healthy = false
+
+	warmUp(context.Background(), st.Servers, 3)
+	if got := conns.Load(); got != 3 {
+		t.Errorf("warm-up opened %d connections, want 3", got)
+	}
+	if got := unhealthyConns.Load(); got != 0 {
+		t.Errorf("warm-up opened %d connections to an unhealthy server, want 0", got)
+	}
+
+	// Concurrent requests use the warmed up connections.
+	block.Store(true)
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(lb, httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+	for active(st.Servers[0]) != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if got := conns.Load(); got != 3 {
+		t.Errorf("%d connections after the requests, want the 3 warmed up", got)
+	}
+}
+
+func TestWarmUpTimeout(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	server, err := newServer(ServerConfig{URL: backend.URL, Weight: 1}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	warmUp(ctx, []*Server{server}, 2)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("warm-up of a server that never answers took %s, want its timeout", d)
+	}
+}
+
+func TestWarmUpBeforeListening(t *testing.T) {
+	var requests atomic.Int64
+	warming := make(chan struct{}, 2)
+	release := make(chan struct{})
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			warming <- struct{}{}
+			<-release
+		}
+	})
+	var releaseOnce sync.Once
+	t.Cleanup(func() { releaseOnce.Do(func() { close(release) }) })
+
+	address := freeAddress(t)
+	cmd := mainCommand("-config", writeConfig(t, fmt.Sprintf(`{
+		"servers": [{"url": %q}],
+		"disableHealthChecks": true,
+		"listenPort": %q,
+		"warmUp": {"connections": 2, "timeout": "10s"}
+	}`, backend.URL, address)))
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		<-done
+	})
+
+	for range 2 {
+		select {
+		case <-warming:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no warm-up requests")
+		}
+	}
+	// The listener is not started while the warm-up is blocked.
+	for deadline := time.Now().Add(200 * time.Millisecond); time.Now().Before(deadline); {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			t.Fatal("listening before the end of the warm-up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	releaseOnce.Do(func() { close(release) })
+	res, err := getWhenListening(t, "http://"+address)
+	if err != nil {
+		t.Fatalf("not listening after the warm-up: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("request after the warm-up: %d, want 200", res.StatusCode)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import "fmt"
+
+// minWeightFactor is the lowest weight factor, so that servers answering
+// with errors keep receiving some requests to recover.
+const minWeightFactor = 0.01
+
+// WeightDecayConfig represents the configuration of the weight decay of
+// servers answering with errors.
+type WeightDecayConfig struct {
+	// Decay is the fraction of the effective weight of a server removed
+	// on each error, from 0 to 1, e.g. 0.5 halves it.
+	Decay float64 `json:"decay"`
+	// Recovery is the fraction of the weight of a server restored on each
+	// successful response, from 0 to 1.
+	Recovery float64 `json:"recovery"`
+}
+
+// weightDecay reduces the effective weight of servers answering with
+// errors, restoring it as they recover.
+type weightDecay struct {
+	decay    float64
+	recovery float64
+}
+
+// newWeightDecay returns the weight decay described by config, or nil if
+// it is disabled.
+func newWeightDecay(config *WeightDecayConfig) (*weightDecay, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if config.Decay <= 0 || config.Decay >= 1 {
+		return nil, fmt.Errorf("parsing errorWeightDecay.decay: must be between 0 and 1 exclusive")
+	}
+	if config.Recovery <= 0 || config.Recovery > 1 {
+		return nil, fmt.Errorf("parsing errorWeightDecay.recovery: must be greater than 0 and at most 1")
+	}
+	return &weightDecay{decay: config.Decay, recovery: config.Recovery}, nil
+}
+
+// Observe updates the weight factor of s after a response, failed if it
+// is an error or has a 5xx status code.
+func (d *weightDecay) Observe(s *Server, failed bool) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	if failed {
+		s.WeightFactor = max(s.WeightFactor*(1-d.decay), minWeightFactor)
+	} else {
+		s.WeightFactor = min(s.WeightFactor+d.recovery, 1)
+	}
+}